@@ -0,0 +1,251 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// outcomes of an audited action
+const (
+	auditSucceeded  = "succeeded"
+	auditFailed     = "failed"
+	auditRejected   = "rejected"
+	auditDenied     = "denied"
+	auditSuperseded = "superseded"
+)
+
+// action recorded for a deploy to an environment which already exists
+const auditUpdate = "update"
+
+// auditEntry records who did what to an environment and how it went
+type auditEntry struct {
+	Time           time.Time         `json:"time"`
+	Caller         string            `json:"caller,omitempty"`
+	Cluster        string            `json:"cluster,omitempty"`
+	Action         string            `json:"action"`
+	Branch         string            `json:"branch"`
+	ImageNamespace string            `json:"imageNamespace,omitempty"`
+	Images         []imageResolution `json:"images,omitempty"`
+	Outcome        string            `json:"outcome"`
+	Code           int               `json:"code,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	Duration       string            `json:"duration,omitempty"`
+}
+
+// auditLog keeps the most recent entries for GET /audit and writes every
+// entry as a json line to the audit-log file
+type auditLog struct {
+	sync.Mutex
+	entries []auditEntry
+	history int
+	out     io.Writer
+}
+
+// audit trail of deploys, updates and deletes, created once flags are parsed
+var audit *auditLog
+
+// newAuditLog opens the audit log file, "-" writes to stdout and an empty path keeps entries in memory only
+func newAuditLog(path string, history int) (*auditLog, error) {
+	a := &auditLog{history: history}
+
+	switch path {
+	case "":
+	case "-":
+		a.out = os.Stdout
+	default:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.out = file
+	}
+
+	return a, nil
+}
+
+// record adds an entry to the audit trail and an event to the branch namespace
+func (a *auditLog) record(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+
+	a.Lock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > a.history {
+		a.entries = a.entries[len(a.entries)-a.history:]
+	}
+	if a.out != nil {
+		if err := json.NewEncoder(a.out).Encode(entry); err != nil {
+			log.Println("[auditLog] Error writing audit entry:", err)
+		}
+	}
+	a.Unlock()
+
+	recordEvent(entry)
+}
+
+// recordEvent adds a kubernetes event for an audit entry to the branch namespace,
+// a deleted namespace, or one a rejected deploy never created, has nowhere to keep it
+func recordEvent(entry auditEntry) {
+	if entry.Outcome == auditDenied || (entry.Action == actionDelete && entry.Outcome == auditSucceeded) {
+		return
+	}
+
+	c, err := clusterNamed(entry.Cluster)
+	if err != nil {
+		log.Println("[recordEvent] Error finding cluster:", err)
+		return
+	}
+	if _, err := getNamespace(c.client, entry.Branch); err != nil {
+		return
+	}
+
+	eventType := v1.EventTypeNormal
+	if entry.Outcome != auditSucceeded {
+		eventType = v1.EventTypeWarning
+	}
+
+	message := fmt.Sprintf("%s by %s %s", entry.Action, entry.Caller, entry.Outcome)
+	if entry.Error != "" {
+		message = fmt.Sprintf("%s: %s", message, entry.Error)
+	}
+
+	now := unversioned.NewTime(entry.Time)
+	event := &v1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", entry.Branch, entry.Time.UnixNano()),
+			Namespace: entry.Branch,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "Namespace",
+			APIVersion: "v1",
+			Name:       entry.Branch,
+		},
+		Reason:         auditReason(entry),
+		Message:        message,
+		Source:         v1.EventSource{Component: "emmie"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	if _, err := c.client.Core().Events(entry.Branch).Create(event); err != nil {
+		log.Println("[recordEvent] Error creating event:", err)
+	}
+}
+
+// auditReason names an event after the action and its outcome (e.g. DeploySucceeded)
+func auditReason(entry auditEntry) string {
+	return capitalize(entry.Action) + capitalize(entry.Outcome)
+}
+
+// capitalize upper cases the first letter of a word
+func capitalize(word string) string {
+	if word == "" {
+		return word
+	}
+	return strings.ToUpper(word[:1]) + word[1:]
+}
+
+// query lists the entries of the given clusters matching a filter, newest first
+func (a *auditLog) query(filter auditEntry, clusterNames []string, since time.Time, limit int) []auditEntry {
+	a.Lock()
+	defer a.Unlock()
+
+	matches := []auditEntry{}
+	for i := len(a.entries) - 1; i >= 0 && (limit <= 0 || len(matches) < limit); i-- {
+		entry := a.entries[i]
+		if (filter.Branch != "" && entry.Branch != filter.Branch) ||
+			(filter.Caller != "" && entry.Caller != filter.Caller) ||
+			(filter.Cluster != "" && entry.Cluster != filter.Cluster) ||
+			!contains(clusterNames, entry.Cluster) ||
+			(filter.Action != "" && entry.Action != filter.Action) ||
+			(filter.Outcome != "" && entry.Outcome != filter.Outcome) ||
+			(filter.ImageNamespace != "" && entry.ImageNamespace != filter.ImageNamespace) ||
+			entry.Time.Before(since) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+
+	return matches
+}
+
+// Audit (GET "/audit")
+func auditRoute(w http.ResponseWriter, r *http.Request) {
+	listed, ok := authorizeListing(w, r)
+	if !ok {
+		return
+	}
+
+	filter := auditEntry{
+		Branch:         r.FormValue("branch"),
+		Caller:         r.FormValue("caller"),
+		Cluster:        r.FormValue("cluster"),
+		Action:         r.FormValue("action"),
+		Outcome:        r.FormValue("outcome"),
+		ImageNamespace: r.FormValue("imageNamespace"),
+	}
+
+	since := time.Time{}
+	if r.FormValue("since") != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, r.FormValue("since")); err != nil {
+			log.Println("[auditRoute] Invalid since:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 100
+	if r.FormValue("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(r.FormValue("limit")); err != nil {
+			log.Println("[auditRoute] Invalid limit:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(audit.query(filter, clusterNames(listed), since, limit)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditLogHistory(t *testing.T) {
+	tests := []struct {
+		history int
+		want    []string
+	}{
+		{history: 0, want: []string{}},
+		{history: 2, want: []string{"c", "b"}},
+		{history: 5, want: []string{"c", "b", "a"}},
+	}
+
+	for _, test := range tests {
+		a, err := newAuditLog("", test.history)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// denied entries don't become events, so no cluster is needed
+		for _, branch := range []string{"a", "b", "c"} {
+			a.record(auditEntry{Cluster: "dev", Action: actionDeploy, Branch: branch, Outcome: auditDenied})
+		}
+
+		got := a.query(auditEntry{}, []string{"dev"}, time.Time{}, 0)
+		if len(got) != len(test.want) {
+			t.Errorf("history %d kept %d entries, want %v", test.history, len(got), test.want)
+			continue
+		}
+		for i, entry := range got {
+			if entry.Branch != test.want[i] {
+				t.Errorf("history %d entry %d = %s, want %s", test.history, i, entry.Branch, test.want[i])
+			}
+		}
+	}
+}
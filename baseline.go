@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// validateOverlay checks an overlay deploy has what it needs to decide which
+// workloads belong to the branch
+func validateOverlay(c *cluster, overlay bool, baselineNamespace string) error {
+	if !overlay {
+		return nil
+	}
+
+	if baselineNamespace == "" {
+		return errors.New("overlay deploys require a baseline namespace")
+	}
+
+	if c.AWSRegistryID == "" {
+		return errors.New("overlay deploys require ECR lookups, set awsregistryid")
+	}
+
+	return nil
+}
+
+// externalNameService builds a service in the branch namespace which resolves
+// to the service of the same name in the baseline namespace
+func externalNameService(svc v1.Service, namespace, baselineNamespace string) *v1.Service {
+	requestService := &v1.Service{
+		TypeMeta: unversioned.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      svc.ObjectMeta.Name,
+			Namespace: namespace,
+			Labels:    svc.Labels,
+		},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: fmt.Sprintf("%s.%s.svc.%s", svc.ObjectMeta.Name, baselineNamespace, *argClusterDomain),
+		},
+	}
+
+	ports := []v1.ServicePort{}
+	for _, port := range svc.Spec.Ports {
+		ports = append(ports, v1.ServicePort{
+			Name:     port.Name,
+			Protocol: port.Protocol,
+			Port:     port.Port,
+		})
+	}
+	requestService.Spec.Ports = ports
+
+	return requestService
+}
+
+// servesWorkload checks whether a service selects the pods of any workload
+// cloned into the branch
+func servesWorkload(svc v1.Service, podLabels []map[string]string) bool {
+	if len(svc.Spec.Selector) == 0 {
+		return false
+	}
+
+	selector := labels.SelectorFromSet(labels.Set(svc.Spec.Selector))
+	for _, pl := range podLabels {
+		if selector.Matches(labels.Set(pl)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routesToAny checks whether an ingress has a backend in the set of services
+func routesToAny(ingress v1beta1.Ingress, services map[string]bool) bool {
+	if ingress.Spec.Backend != nil && services[ingress.Spec.Backend.ServiceName] {
+		return true
+	}
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if services[path.Backend.ServiceName] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
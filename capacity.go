@@ -0,0 +1,301 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annotations on a branch namespace recording when it was last deployed, and
+// who last deployed and deleted it
+const (
+	deployedAtAnnotation = "emmie-deployed-at"
+	deployedByAnnotation = "emmie-deployed-by"
+	deletedByAnnotation  = "emmie-deleted-by"
+)
+
+// policies for making room when the environment limits are reached
+const (
+	evictNone           = ""
+	evictOldest         = "oldest"
+	evictLeastRecentUse = "least-recently-deployed"
+)
+
+// environment is a branch namespace managed by emmie
+type environment struct {
+	Cluster        string    `json:"cluster"`
+	Name           string    `json:"name"`
+	ImageNamespace string    `json:"imageNamespace"`
+	Created        time.Time `json:"created"`
+	LastDeployed   time.Time `json:"lastDeployed"`
+	DeployedBy     string    `json:"deployedBy,omitempty"`
+}
+
+// capacityReport describes the environment limits and current usage
+type capacityReport struct {
+	MaxEnvironments             int            `json:"maxEnvironments"`
+	MaxEnvironmentsPerNamespace int            `json:"maxEnvironmentsPerNamespace"`
+	EvictionPolicy              string         `json:"evictionPolicy"`
+	Total                       int            `json:"total"`
+	PerCluster                  map[string]int `json:"perCluster"`
+	PerNamespace                map[string]int `json:"perNamespace"`
+	Environments                []environment  `json:"environments"`
+	Error                       string         `json:"error,omitempty"`
+}
+
+// capacityError is returned when a new environment doesn't fit
+type capacityError struct {
+	report *capacityReport
+}
+
+func (e *capacityError) Error() string {
+	return e.report.Error
+}
+
+// listEnvironments lists the branch namespaces emmie manages in a cluster,
+// namespaces which are already being deleted aren't counted
+func listEnvironments(c *cluster) ([]environment, error) {
+	nss, err := listNamespaces(c.client, "deployedBy", "emmie")
+	if err != nil {
+		return nil, err
+	}
+
+	environments := []environment{}
+	for _, ns := range nss.Items {
+		if ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+
+		env := environment{
+			Cluster:        c.Name,
+			Name:           ns.Name,
+			ImageNamespace: ns.Annotations[imageNamespaceAnnotation],
+			DeployedBy:     ns.Annotations[deployedByAnnotation],
+			Created:        ns.CreationTimestamp.Time,
+			LastDeployed:   ns.CreationTimestamp.Time,
+		}
+
+		if deployedAt, err := time.Parse(time.RFC3339, ns.Annotations[deployedAtAnnotation]); err == nil {
+			env.LastDeployed = deployedAt
+		}
+
+		environments = append(environments, env)
+	}
+
+	return environments, nil
+}
+
+// newCapacityReport summarises a set of environments against the limits
+func newCapacityReport(environments []environment) *capacityReport {
+	report := &capacityReport{
+		MaxEnvironments:             *argMaxEnvironments,
+		MaxEnvironmentsPerNamespace: *argMaxPerNamespace,
+		EvictionPolicy:              *argEvictionPolicy,
+		Total:                       len(environments),
+		PerCluster:                  map[string]int{},
+		PerNamespace:                map[string]int{},
+		Environments:                environments,
+	}
+
+	for _, env := range environments {
+		report.PerCluster[env.Cluster]++
+		report.PerNamespace[env.ImageNamespace]++
+	}
+
+	return report
+}
+
+// admitEnvironment makes room for a new environment and creates its namespace,
+// holding the cluster's admission lock so deploys running at the same time
+// can't all pass the limits before any of them is counted, the lock is let go
+// while an environment is evicted as its pre-delete hooks can take minutes
+func admitEnvironment(plan *deployPlan, imageNamespace string) ([]string, error) {
+	c := plan.cluster
+	evicted := []string{}
+
+	for {
+		c.admission.Lock()
+		next, err := makeRoom(c, plan.Namespace, imageNamespace, evicted)
+		if err != nil || next == nil {
+			// a failure here is left to applyDeployPlan, which creates or updates the namespace
+			if err == nil && createNamespace(c.client, plan.Namespace, plan.namespaceAnnotations(nil)) == nil {
+				plan.namespaceCreated = true
+			}
+			c.admission.Unlock()
+			return evicted, err
+		}
+		c.admission.Unlock()
+
+		log.Printf("[admitEnvironment] %s, evicting environment %s", next.report.Error, next.victim.Name)
+		status, err := deleteEnvironment(c, next.victim.Name, next.job.Caller, false)
+		if err != nil {
+			queue.finish(next.job, jobResult{Code: http.StatusInternalServerError, Body: status.snapshot()})
+			next.report.Error = fmt.Sprintf("%s, evicting %s failed: %v", next.report.Error, next.victim.Name, err)
+			return evicted, &capacityError{report: next.report}
+		}
+		queue.finish(next.job, jobResult{Code: http.StatusOK, Body: status.snapshot()})
+		evicted = append(evicted, next.victim.Name)
+	}
+}
+
+// eviction is an environment claimed to make room for a new one
+type eviction struct {
+	victim environment
+	job    *queuedJob
+	report *capacityReport
+}
+
+// makeRoom checks a new environment for imageNamespace fits within the limits
+// of a cluster, environments already evicted for it are counted as gone, if it
+// doesn't fit and a policy is set the environment to evict is claimed and
+// returned, it's called with the cluster's admission lock held
+func makeRoom(c *cluster, branchName, imageNamespace string, evicted []string) (*eviction, error) {
+	if *argMaxEnvironments <= 0 && *argMaxPerNamespace <= 0 {
+		return nil, nil
+	}
+
+	listed, err := listEnvironments(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// environments being evicted for other deploys are still counted until
+	// their namespaces terminate, and are claimed so they can't be picked twice
+	environments := []environment{}
+	for _, env := range listed {
+		if !contains(evicted, env.Name) {
+			environments = append(environments, env)
+		}
+	}
+
+	report := newCapacityReport(environments)
+	candidates := []environment{}
+
+	if *argMaxEnvironments > 0 && report.Total >= *argMaxEnvironments {
+		report.Error = fmt.Sprintf("limit of %d environments reached", *argMaxEnvironments)
+		candidates = environments
+	} else if *argMaxPerNamespace > 0 && report.PerNamespace[imageNamespace] >= *argMaxPerNamespace {
+		report.Error = fmt.Sprintf("limit of %d environments for %s reached", *argMaxPerNamespace, imageNamespace)
+		for _, env := range environments {
+			if env.ImageNamespace == imageNamespace {
+				candidates = append(candidates, env)
+			}
+		}
+	} else {
+		return nil, nil
+	}
+
+	victim, job, ok := evictionCandidate(c, candidates, branchName, "evicted for "+branchName)
+	if !ok {
+		return nil, &capacityError{report: report}
+	}
+
+	return &eviction{victim: victim, job: job, report: report}, nil
+}
+
+// evictionCandidate picks the environment to remove under the eviction policy
+// and claims its branch in the queue, so nothing can deploy or delete it while
+// it is evicted, the claimed job has to be finished by the caller
+func evictionCandidate(c *cluster, candidates []environment, branchName, caller string) (environment, *queuedJob, bool) {
+	sorted := []environment{}
+	for _, env := range candidates {
+		if env.Name != branchName {
+			sorted = append(sorted, env)
+		}
+	}
+
+	switch *argEvictionPolicy {
+	case evictOldest:
+		sort.Sort(environmentsByCreated(sorted))
+	case evictLeastRecentUse:
+		sort.Sort(environmentsByLastDeployed(sorted))
+	default:
+		return environment{}, nil, false
+	}
+
+	// environments with a deploy or delete in flight are left alone
+	for _, env := range sorted {
+		if job, ok := queue.claim(c, env.Name, actionDelete, caller); ok {
+			return env, job, true
+		}
+	}
+	return environment{}, nil, false
+}
+
+// environmentsByCreated sorts environments oldest first
+type environmentsByCreated []environment
+
+func (e environmentsByCreated) Len() int           { return len(e) }
+func (e environmentsByCreated) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e environmentsByCreated) Less(i, j int) bool { return e[i].Created.Before(e[j].Created) }
+
+// environmentsByLastDeployed sorts environments least recently deployed first
+type environmentsByLastDeployed []environment
+
+func (e environmentsByLastDeployed) Len() int      { return len(e) }
+func (e environmentsByLastDeployed) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e environmentsByLastDeployed) Less(i, j int) bool {
+	return e[i].LastDeployed.Before(e[j].LastDeployed)
+}
+
+// Capacity (GET "/capacity")
+func capacityRoute(w http.ResponseWriter, r *http.Request) {
+	listed, ok := authorizeListing(w, r)
+	if !ok {
+		return
+	}
+
+	// the limits apply to each cluster, the report lists the environments of all of them
+	environments := []environment{}
+	var err error
+	for _, c := range listed {
+		var list []environment
+		list, err = listEnvironments(c)
+		if err != nil {
+			break
+		}
+		environments = append(environments, list...)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newCapacityReport(environments)); err != nil {
+			panic(err)
+		}
+	}
+}
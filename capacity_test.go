@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/rest"
+)
+
+func TestMakeRoomClaimsOneVictimPerDeploy(t *testing.T) {
+	defer func(q *deployQueue, max, perNamespace int, policy string) {
+		queue, *argMaxEnvironments, *argMaxPerNamespace, *argEvictionPolicy = q, max, perNamespace, policy
+	}(queue, *argMaxEnvironments, *argMaxPerNamespace, *argEvictionPolicy)
+	queue = newDeployQueue(1)
+	*argMaxEnvironments, *argMaxPerNamespace, *argEvictionPolicy = 2, 0, evictOldest
+
+	// both environments stay listed as if their evictions were still running
+	created := time.Now().Add(-time.Hour)
+	namespaces := v1.NamespaceList{}
+	for i, name := range []string{"feature-a", "feature-b"} {
+		ns := v1.Namespace{}
+		ns.Name = name
+		ns.Labels = map[string]string{"deployedBy": "emmie"}
+		ns.CreationTimestamp = unversioned.NewTime(created.Add(time.Duration(i) * time.Minute))
+		namespaces.Items = append(namespaces.Items, ns)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(namespaces)
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &cluster{Name: "dev", client: client}
+
+	first, err := makeRoom(dev, "feature-c", "team", nil)
+	if err != nil || first == nil || first.victim.Name != "feature-a" {
+		t.Fatalf("first deploy got %+v, %v, want feature-a evicted", first, err)
+	}
+
+	// feature-a still counts against the limit for other deploys while it's evicted
+	second, err := makeRoom(dev, "feature-d", "team", nil)
+	if err != nil || second == nil || second.victim.Name != "feature-b" {
+		t.Fatalf("second deploy got %+v, %v, want feature-b evicted", second, err)
+	}
+
+	if _, err := makeRoom(dev, "feature-e", "team", nil); err == nil {
+		t.Error("third deploy found room with every environment already claimed")
+	} else if _, ok := err.(*capacityError); !ok {
+		t.Errorf("third deploy got %v, want a capacity error", err)
+	}
+
+	if next, err := makeRoom(dev, "feature-c", "team", []string{"feature-a"}); err != nil || next != nil {
+		t.Errorf("first deploy after its eviction got %+v, %v, want room", next, err)
+	}
+
+	queue.finish(first.job, jobResult{Code: http.StatusOK})
+	queue.finish(second.job, jobResult{Code: http.StatusOK})
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.4/kubernetes"
+)
+
+// cluster is a kubernetes cluster emmie deploys to, settings left empty
+// fall back to the matching argument
+type cluster struct {
+	Name              string `json:"name"`
+	Kubeconfig        string `json:"kubeconfig,omitempty"`
+	Context           string `json:"context,omitempty"`
+	MasterURL         string `json:"masterURL,omitempty"`
+	TemplateNamespace string `json:"templateNamespace,omitempty"`
+	SubDomain         string `json:"subdomain,omitempty"`
+	DockerRegistry    string `json:"dockerRegistry,omitempty"`
+	AWSRegion         string `json:"awsRegion,omitempty"`
+	AWSRegistryID     string `json:"awsRegistryID,omitempty"`
+
+	client *kubernetes.Clientset
+
+	// admission is held while a new environment is counted against the
+	// capacity limits, room is made for it and its namespace is created
+	admission sync.Mutex
+}
+
+// clustersFile lists the clusters emmie deploys to
+type clustersFile struct {
+	Clusters []*cluster `json:"clusters"`
+}
+
+// clusters emmie deploys to, requests which don't name one go to the first
+var (
+	clusters       []*cluster
+	defaultCluster *cluster
+)
+
+// loadClusters reads the clusters file and connects to each cluster, without
+// a file the single cluster is described by the arguments
+func loadClusters(path string) error {
+	loaded := []*cluster{}
+
+	if path == "" {
+		loaded = append(loaded, &cluster{
+			Name:       *argClusterName,
+			Kubeconfig: *argKubecfgFile,
+			Context:    *argKubeContext,
+			MasterURL:  *argKubeMasterURL,
+		})
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		file := clustersFile{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		if len(file.Clusters) == 0 {
+			return fmt.Errorf("%s lists no clusters", path)
+		}
+
+		for _, c := range file.Clusters {
+			if c.Kubeconfig == "" {
+				c.Kubeconfig = *argKubecfgFile
+			}
+		}
+		loaded = file.Clusters
+	}
+
+	seen := map[string]bool{}
+	for _, c := range loaded {
+		if c.Name == "" {
+			return fmt.Errorf("cluster without a name")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("cluster %s listed twice", c.Name)
+		}
+		seen[c.Name] = true
+
+		c.setDefaults()
+
+		config, target, err := kubeConfig(c.Kubeconfig, c.Context, c.MasterURL)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %v", c.Name, err)
+		}
+
+		c.client, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %v", c.Name, err)
+		}
+
+		log.Printf("[Emmie] Cluster %s targets %s", c.Name, target)
+	}
+
+	clusters = loaded
+	defaultCluster = loaded[0]
+	return nil
+}
+
+// setDefaults fills the settings a cluster doesn't have from the arguments
+func (c *cluster) setDefaults() {
+	if c.TemplateNamespace == "" {
+		c.TemplateNamespace = *argTemplateNamespace
+	}
+	if c.SubDomain == "" {
+		c.SubDomain = *argSubDomain
+	}
+	if c.DockerRegistry == "" {
+		c.DockerRegistry = *argDockerRegistry
+	}
+	if c.DockerRegistry != "" && !strings.HasSuffix(c.DockerRegistry, "/") {
+		c.DockerRegistry = fmt.Sprintf("%s/", c.DockerRegistry)
+	}
+	if c.AWSRegion == "" {
+		c.AWSRegion = *argAwsRegion
+	}
+	if c.AWSRegistryID == "" {
+		c.AWSRegistryID = *argsAWSRegistryID
+	}
+}
+
+// clusterNamed finds a cluster by name, an empty name is the default cluster
+func clusterNamed(name string) (*cluster, error) {
+	if name == "" {
+		return defaultCluster, nil
+	}
+
+	for _, c := range clusters {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cluster %q", name)
+}
+
+// requestCluster is the cluster named by the cluster parameter of a request,
+// responding with 400 when there is no such cluster
+func requestCluster(w http.ResponseWriter, r *http.Request) (*cluster, bool) {
+	c, err := clusterNamed(r.FormValue("cluster"))
+	if err != nil {
+		log.Println("[requestCluster]", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	return c, true
+}
+
+// requestClusters are the clusters a listing covers, every cluster unless the
+// request names one
+func requestClusters(w http.ResponseWriter, r *http.Request) ([]*cluster, bool) {
+	if r.FormValue("cluster") == "" {
+		return clusters, true
+	}
+
+	c, ok := requestCluster(w, r)
+	if !ok {
+		return nil, false
+	}
+	return []*cluster{c}, true
+}
+
+// clusterNames are the names of some clusters
+func clusterNames(listed []*cluster) []string {
+	names := []string{}
+	for _, c := range listed {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// jobKey names a branch of a cluster for the deploy queue and statuses
+func jobKey(c *cluster, branchName string) string {
+	return c.Name + "/" + branchName
+}
@@ -31,6 +31,7 @@ import (
 	"log"
 	"net/http"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -44,7 +45,7 @@ func getConfigMapRoute(w http.ResponseWriter, r *http.Request) {
 	ConfigMapName := vars["ConfigMapName"]
 	namespace := vars["namespace"]
 
-	ConfigMap, err := getConfigMap(ConfigMapName, namespace)
+	ConfigMap, err := getConfigMap(defaultCluster.client, ConfigMapName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +65,7 @@ func getConfigMapsRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	ConfigMap, err := listConfigMaps(namespace, key, value)
+	ConfigMap, err := listConfigMaps(defaultCluster.client, namespace, key, value)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +83,7 @@ func getConfigMapsRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listConfigMapsByNamespace(namespace string) (*v1.ConfigMapList, error) {
+func listConfigMapsByNamespace(client *kubernetes.Clientset, namespace string) (*v1.ConfigMapList, error) {
 	list, err := client.Core().ConfigMaps(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -97,7 +98,7 @@ func listConfigMapsByNamespace(namespace string) (*v1.ConfigMapList, error) {
 	return list, nil
 }
 
-func listConfigMaps(namespace, labelKey, labelValue string) (*v1.ConfigMapList, error) {
+func listConfigMaps(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1.ConfigMapList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Core().ConfigMaps(namespace).List(listOptions)
@@ -114,7 +115,7 @@ func listConfigMaps(namespace, labelKey, labelValue string) (*v1.ConfigMapList,
 	return list, nil
 }
 
-func getConfigMap(ConfigMapName, namespace string) (*v1.ConfigMap, error) {
+func getConfigMap(client *kubernetes.Clientset, ConfigMapName, namespace string) (*v1.ConfigMap, error) {
 	svc, err := client.ConfigMaps(namespace).Get(ConfigMapName)
 
 	if err != nil {
@@ -125,7 +126,7 @@ func getConfigMap(ConfigMapName, namespace string) (*v1.ConfigMap, error) {
 	return svc, nil
 }
 
-func createConfigMap(namespace string, ConfigMap *v1.ConfigMap) error {
+func createConfigMap(client *kubernetes.Clientset, namespace string, ConfigMap *v1.ConfigMap) error {
 	_, err := client.Core().ConfigMaps(namespace).Create(ConfigMap)
 
 	if err != nil {
@@ -134,7 +135,7 @@ func createConfigMap(namespace string, ConfigMap *v1.ConfigMap) error {
 	return err
 }
 
-func deleteConfigMap(namespace, name string) error {
+func deleteConfigMap(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: nil on the DeleteOptions?
 	err := client.Core().ConfigMaps(namespace).Delete(name, nil)
 
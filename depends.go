@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// annotation on a template workload listing the workloads it needs running first
+const dependsOnAnnotation = "emmie-depends-on"
+
+// dependsOn lists the workloads named by the emmie-depends-on annotation
+func dependsOn(annotations map[string]string) []string {
+	names := []string{}
+	for _, name := range strings.Split(annotations[dependsOnAnnotation], ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// dependencyLayers orders workloads so each layer only depends on the layers
+// before it, dependencies on workloads which aren't in deps are ignored since
+// they are already running elsewhere (e.g. in the baseline namespace)
+func dependencyLayers(deps map[string][]string) ([][]string, error) {
+	remaining := map[string]map[string]bool{}
+	for name, needs := range deps {
+		remaining[name] = map[string]bool{}
+		for _, need := range needs {
+			if _, ok := deps[need]; !ok {
+				log.Printf("[dependencyLayers] %s depends on %s which isn't being deployed, ignoring", name, need)
+				continue
+			}
+			if need != name {
+				remaining[name][need] = true
+			} else {
+				return nil, fmt.Errorf("dependency cycle: %s depends on itself", name)
+			}
+		}
+	}
+
+	layers := [][]string{}
+	for len(remaining) > 0 {
+		layer := []string{}
+		for name, needs := range remaining {
+			if len(needs) == 0 {
+				layer = append(layer, name)
+			}
+		}
+
+		if len(layer) == 0 {
+			cycles := []string{}
+			for _, cycle := range dependencyCycles(remaining) {
+				cycles = append(cycles, strings.Join(cycle, ", "))
+			}
+			return nil, fmt.Errorf("dependency cycle between workloads: %s", strings.Join(cycles, "; "))
+		}
+
+		sort.Strings(layer)
+		for _, name := range layer {
+			delete(remaining, name)
+		}
+		for _, needs := range remaining {
+			for _, name := range layer {
+				delete(needs, name)
+			}
+		}
+
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
+
+// dependencyCycles finds the groups of workloads which depend on each other
+// (the strongly connected components with more than one workload), leaving
+// out workloads which only wait on a cycle
+func dependencyCycles(deps map[string]map[string]bool) [][]string {
+	names := []string{}
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := map[string]int{}
+	lowlink := map[string]int{}
+	onStack := map[string]bool{}
+	stack := []string{}
+	cycles := [][]string{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		index[name] = len(index)
+		lowlink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+
+		needs := []string{}
+		for need := range deps[name] {
+			needs = append(needs, need)
+		}
+		sort.Strings(needs)
+
+		for _, need := range needs {
+			if _, seen := index[need]; !seen {
+				visit(need)
+				if lowlink[need] < lowlink[name] {
+					lowlink[name] = lowlink[need]
+				}
+			} else if onStack[need] && index[need] < lowlink[name] {
+				lowlink[name] = index[need]
+			}
+		}
+
+		if lowlink[name] != index[name] {
+			return
+		}
+
+		component := []string{}
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			component = append(component, member)
+			if member == name {
+				break
+			}
+		}
+		if len(component) > 1 {
+			sort.Strings(component)
+			cycles = append(cycles, component)
+		}
+	}
+
+	for _, name := range names {
+		if _, seen := index[name]; !seen {
+			visit(name)
+		}
+	}
+
+	sort.Sort(cyclesByFirst(cycles))
+	return cycles
+}
+
+// cyclesByFirst sorts cycles by their first workload
+type cyclesByFirst [][]string
+
+func (c cyclesByFirst) Len() int           { return len(c) }
+func (c cyclesByFirst) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c cyclesByFirst) Less(i, j int) bool { return c[i][0] < c[j][0] }
+
+// inLayer checks whether a workload is part of a layer
+func inLayer(layer []string, name string) bool {
+	return contains(layer, name)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependsOn(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: []string{}},
+		{value: "db", want: []string{"db"}},
+		{value: " db , cache,,", want: []string{"db", "cache"}},
+	}
+
+	for _, test := range tests {
+		got := dependsOn(map[string]string{dependsOnAnnotation: test.value})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("dependsOn(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestDependencyLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		deps map[string][]string
+		want [][]string
+		err  string
+	}{
+		{
+			name: "no dependencies",
+			deps: map[string][]string{"web": nil, "api": nil},
+			want: [][]string{{"api", "web"}},
+		},
+		{
+			name: "chain",
+			deps: map[string][]string{"web": {"api"}, "api": {"db"}, "db": nil},
+			want: [][]string{{"db"}, {"api"}, {"web"}},
+		},
+		{
+			name: "diamond",
+			deps: map[string][]string{"web": {"api", "auth"}, "api": {"db"}, "auth": {"db"}, "db": nil},
+			want: [][]string{{"db"}, {"api", "auth"}, {"web"}},
+		},
+		{
+			name: "dependency outside the deploy",
+			deps: map[string][]string{"web": {"shared-db"}},
+			want: [][]string{{"web"}},
+		},
+		{
+			name: "self dependency",
+			deps: map[string][]string{"web": {"web"}},
+			err:  "dependency cycle: web depends on itself",
+		},
+		{
+			name: "cycle with dependents",
+			deps: map[string][]string{"web": {"api"}, "api": {"auth"}, "auth": {"api"}, "db": nil},
+			err:  "dependency cycle between workloads: api, auth",
+		},
+		{
+			name: "two cycles",
+			deps: map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"d"}, "d": {"e"}, "e": {"c"}, "f": {"a", "c"}},
+			err:  "dependency cycle between workloads: a, b; c, d, e",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := dependencyLayers(test.deps)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: dependencyLayers error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: dependencyLayers error = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: dependencyLayers = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
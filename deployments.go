@@ -33,6 +33,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -44,7 +45,7 @@ func getDeploymentRoute(w http.ResponseWriter, r *http.Request) {
 	deploymentName := vars["deploymentName"]
 	namespace := vars["namespace"]
 
-	rc, err := getDeployment(deploymentName, namespace)
+	rc, err := getDeployment(defaultCluster.client, deploymentName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +65,21 @@ func getDeploymentsRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	rc, err := listDeployments(namespace, key, value)
+	listed, ok := authorizeListing(w, r)
+	if !ok {
+		return
+	}
+
+	rc := &v1beta1.DeploymentList{}
+	var err error
+	for _, c := range listed {
+		var list *v1beta1.DeploymentList
+		list, err = listDeployments(c.client, namespace, key, value)
+		if err != nil {
+			break
+		}
+		rc.Items = append(rc.Items, list.Items...)
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +97,7 @@ func getDeploymentsRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listDeploymentsByNamespace(namespace string) (*v1beta1.DeploymentList, error) {
+func listDeploymentsByNamespace(client *kubernetes.Clientset, namespace string) (*v1beta1.DeploymentList, error) {
 	list, err := client.Deployments(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -92,7 +107,7 @@ func listDeploymentsByNamespace(namespace string) (*v1beta1.DeploymentList, erro
 	return list, nil
 }
 
-func listDeployments(namespace, labelKey, labelValue string) (*v1beta1.DeploymentList, error) {
+func listDeployments(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1beta1.DeploymentList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Deployments(namespace).List(listOptions)
@@ -104,7 +119,7 @@ func listDeployments(namespace, labelKey, labelValue string) (*v1beta1.Deploymen
 	return list, nil
 }
 
-func getDeployment(DeploymentName, namespace string) (*v1beta1.Deployment, error) {
+func getDeployment(client *kubernetes.Clientset, DeploymentName, namespace string) (*v1beta1.Deployment, error) {
 	rc, err := client.Deployments(namespace).Get(DeploymentName)
 
 	if err != nil {
@@ -114,7 +129,7 @@ func getDeployment(DeploymentName, namespace string) (*v1beta1.Deployment, error
 	return rc, nil
 }
 
-func createDeployment(namespace string, rc *v1beta1.Deployment) error {
+func createDeployment(client *kubernetes.Clientset, namespace string, rc *v1beta1.Deployment) error {
 	_, err := client.Deployments(namespace).Create(rc)
 
 	if err != nil {
@@ -123,7 +138,7 @@ func createDeployment(namespace string, rc *v1beta1.Deployment) error {
 	return err
 }
 
-func deleteDeployment(namespace, name string) error {
+func deleteDeployment(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: Use nil?
 	err := client.Deployments(namespace).Delete(name, nil)
 
@@ -27,9 +27,9 @@ ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -37,23 +37,67 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"k8s.io/client-go/1.4/kubernetes"
-	"k8s.io/client-go/1.4/pkg/api/v1"
-	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
-	"k8s.io/client-go/1.4/rest"
+	"k8s.io/client-go/1.4/pkg/labels"
 )
 
 var (
 	argListenPort        = flag.Int("listen-port", 9080, "port to have API listen")
+	argTLSCert           = flag.String("tls-cert", "", "Certificate the API is served with, reloaded when it changes")
+	argTLSKey            = flag.String("tls-key", "", "Private key of tls-cert, reloaded when it changes")
+	argTLSReload         = flag.Duration("tls-reload", 30*time.Second, "How often to check tls-cert and tls-key for changes")
+	argTLSSelfSigned     = flag.Bool("tls-self-signed", false, "Serve the API with a certificate generated at startup instead of tls-cert")
+	argInsecureHTTP      = flag.Bool("insecure-http", false, "Serve the API over plain HTTP, for running behind an ingress which terminates TLS")
 	argDockerRegistry    = flag.String("docker-registry", "", "docker registry to use")
-	argKubecfgFile       = flag.String("kubecfg-file", "", "Location of kubecfg file for access to kubernetes master service; --kube_master_url overrides the URL part of this; if neither this nor --kube_master_url are provided, defaults to service account tokens")
+	argKubecfgFile       = flag.String("kubecfg-file", "", "Location of kubecfg file for access to kubernetes master service; --kube-master-url overrides the URL part of this; if neither this nor --kube-master-url are provided, defaults to service account tokens")
 	argKubeMasterURL     = flag.String("kube-master-url", "", "URL to reach kubernetes master. Env variables in this flag will be expanded.")
+	argClusters          = flag.String("clusters", "", "Path to a json or yaml file of the clusters to deploy to, by default the one cluster of kubecfg-file, kube-context and kube-master-url")
+	argClusterName       = flag.String("cluster-name", "default", "Name of the cluster when clusters isn't set")
+	argKubeContext       = flag.String("kube-context", "", "Context of the kubecfg file to use, defaults to its current context")
 	argTemplateNamespace = flag.String("template-namespace", "template", "Namespace to 'clone from when creating new deployments'")
+	argTemplates         = flag.String("template-namespaces", "", "Comma separated list of additional template namespaces a deploy may select with the template parameter")
+	argBaselineNamespace = flag.String("baseline-namespace", "", "Namespace services left out of a partial deploy resolve to, setting to empty string will leave them out entirely")
+	argClusterDomain     = flag.String("cluster-domain", "cluster.local", "DNS domain of the kubernetes cluster")
+	argOverlay           = flag.Bool("overlay", false, "Only clone workloads with a branch image in ECR and point everything else at the baseline namespace")
+	argSubstitute        = flag.Bool("substitute", false, "Expand placeholders in every template object, otherwise only in objects annotated emmie-substitute: \"true\"")
 	argPathToTokens      = flag.String("path-to-tokens", "", "Full path including file name to tokens file for authorization, setting to empty string will disable.")
+	argKubeAuth          = flag.Bool("kube-auth", false, "Authenticate bearer tokens with the cluster's TokenReview api and authorize them with SubjectAccessReviews")
+	argKubeAuthGroup     = flag.String("kube-auth-group", "emmie.upmc.com", "API group of the environments resource checked by SubjectAccessReviews")
+	argQueryToken        = flag.Bool("allow-query-token", true, "Accept tokens in the token query parameter as well as the Authorization header")
+	argOIDCIssuer        = flag.String("oidc-issuer", "", "OIDC issuer whose JWTs are accepted as tokens, setting to empty string will disable")
+	argOIDCAudience      = flag.String("oidc-audience", "", "Audience (client id) JWTs must be issued for, required with oidc-issuer")
+	argOIDCJWKSURL       = flag.String("oidc-jwks-url", "", "URL of the issuer's signing keys, discovered from the issuer when empty")
+	argOIDCUserClaim     = flag.String("oidc-username-claim", "email", "JWT claim identifying the user, sub is used when it is missing")
+	argOIDCGroupsClaim   = flag.String("oidc-groups-claim", "groups", "JWT claim listing the user's groups")
+	argOIDCGroups        = flag.String("oidc-groups", "", "Path to a json or yaml file of the permissions of each group")
+	argTokensReload      = flag.Duration("tokens-reload", 10*time.Second, "How often to check the tokens file for changes, it is also reloaded on SIGHUP")
 	argSubDomain         = flag.String("subdomain", "k8s.local.com", "Subdomain used to configure external routing to branch (e.g. namespace.ci.k8s.local)")
 	argAwsRegion         = flag.String("awsregion", "us-east-1", "Region matching ECR")
 	argsAWSRegistryID    = flag.String("awsregistryid", "", "AWS registryID (account number)")
-	client               *kubernetes.Clientset
+	argVaultAddr         = flag.String("vault-addr", "", "Address of the vault server template secrets are read from (e.g. https://vault:8200)")
+	argVaultAuth         = flag.String("vault-auth", "token", "How to authenticate to vault (token or kubernetes)")
+	argVaultToken        = flag.String("vault-token", os.Getenv("VAULT_TOKEN"), "Vault token used with token auth, defaults to $VAULT_TOKEN")
+	argVaultRole         = flag.String("vault-role", "emmie", "Vault role used with kubernetes auth")
+	argVaultAuthPath     = flag.String("vault-auth-path", "kubernetes", "Mount path of the vault kubernetes auth method")
+	argQuota             = flag.String("quota", "", "Hard limits of the ResourceQuota created in each branch namespace (e.g. pods=20,limits.memory=8Gi)")
+	argQuotaConfig       = flag.String("quota-config", "", "Path to a json or yaml file with the resourceQuota and limitRange specs for each branch namespace")
+	argTemplateQuotas    = flag.Bool("copy-template-quotas", false, "Copy the ResourceQuotas and LimitRanges of the template namespace to each branch namespace")
+	argMaxEnvironments   = flag.Int("max-environments", 0, "Most environments emmie will run at once, 0 for no limit")
+	argMaxPerNamespace   = flag.Int("max-environments-per-namespace", 0, "Most environments emmie will run at once for each image namespace, 0 for no limit")
+	argEvictionPolicy    = flag.String("eviction-policy", "", "Environment removed to make room when a limit is reached (oldest or least-recently-deployed), empty rejects the deploy")
+	argAuditLog          = flag.String("audit-log", "-", "File the audit trail is appended to as json lines, - for stdout and empty to only keep it in memory")
+	argAuditHistory      = flag.Int("audit-history", 1000, "Number of audit entries kept in memory for GET /audit")
+	argRateLimit         = flag.Float64("rate-limit", 0, "Requests per second each token and client address may make, 0 (the default) disables rate limiting")
+	argRateBurst         = flag.Int("rate-burst", 20, "Requests each token and client address may make at once before rate-limit applies")
+	argDestructiveRate   = flag.Float64("destructive-rate", 0.1, "Deploys and deletes per second each token and client address may make, 0 for no separate limit")
+	argDestructiveBurst  = flag.Int("destructive-burst", 5, "Deploys and deletes each token and client address may make at once before destructive-rate applies")
+	argTrustForwarded    = flag.Bool("trust-forwarded-for", false, "Rate limit by the X-Forwarded-For address set by a proxy in front of emmie")
+	argDeployWorkers     = flag.Int("deploy-workers", 4, "Number of deploys and deletes which can run at once")
+	argReadyTimeout      = flag.Duration("ready-timeout", 10*time.Minute, "How long to wait for workloads to become ready before running post-deploy hooks")
+	argHookTimeout       = flag.Duration("hook-timeout", 10*time.Minute, "How long to wait for each hook job to complete")
+	argDryRun            = flag.Bool("dry-run", false, "Print the deploy plan for <namespace> <branchName> and exit without changing the cluster")
+	argOutputFormat      = flag.String("output", outputJSON, "Output format for --dry-run (json or yaml)")
+	argSelector          = flag.String("selector", "", "Label selector limiting which template objects --dry-run clones")
+	argOverridesFile     = flag.String("overrides", "", "Path to a json or yaml file of overrides for --dry-run")
 	defaultReplicaCount  *int32
 )
 
@@ -68,8 +112,7 @@ func indexRoute(w http.ResponseWriter, r *http.Request) {
 
 // Version (GET "/version")
 func versionRoute(w http.ResponseWriter, r *http.Request) {
-	if !tokenIsValid(r.FormValue("token")) {
-		w.WriteHeader(http.StatusUnauthorized)
+	if _, ok := authorize(w, r, actionRead, "", "", ""); !ok {
 		return
 	}
 
@@ -82,356 +125,417 @@ func deployRoute(w http.ResponseWriter, r *http.Request) {
 	branchName := vars["branchName"]
 	imageNamespace := vars["namespace"]
 
-	if !tokenIsValid(r.FormValue("token")) {
-		w.WriteHeader(http.StatusUnauthorized)
+	// sanitize BranchName
+	branchName = sanitizeBranchName(branchName)
+	dryRun := r.FormValue("dryRun") == "true"
+
+	c, ok := requestCluster(w, r)
+	if !ok {
 		return
 	}
 
-	// sanitize BranchName
-	branchName = strings.Replace(branchName, "_", "-", -1)
-	log.Println("[Emmie] is deploying branch:", branchName)
-
-	// create namespace
-	err := createNamespace(branchName)
+	caller, ok := authorize(w, r, actionDeploy, c.Name, imageNamespace, branchName)
+	if !ok {
+		return
+	}
 
+	overrides, err := readOverrides(w, r)
 	if err != nil {
-		// TODO: Don't use error for logic
-		// Existing namespace, do an update
-		log.Println("Existing namespace found: ", branchName, " deleting objects.")
-
-		deleteAllObjects(branchName)
-		deletePodsByNamespace(branchName)
+		log.Println("[deployRoute]", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-		// Meh
-		time.Sleep(time.Second * 4)
+	if dryRun {
+		log.Println("[Emmie] is planning a dry run of branch:", branchName, "for", caller.Name)
 	} else {
-		log.Println("Namespace created, deploying new app...")
+		log.Println("[Emmie] is deploying branch:", branchName, "for", caller.Name)
 	}
 
-	// copy controllers / services based on label query
-	rcs, _ := listReplicationControllersByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(rcs.Items), " template replication controllers to copy.")
-
-	deployments, _ := listDeploymentsByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(deployments.Items), " template deployments to copy.")
-
-	svcs, _ := listServicesByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(svcs.Items), " template services to copy.")
+	templateNamespace, err := resolveTemplateNamespace(c, r.FormValue("template"), branchName)
+	if err != nil {
+		log.Println("[deployRoute]", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	secrets, _ := listSecretsByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(secrets.Items), " template secrets to copy.")
+	selector, err := labels.Parse(r.FormValue("selector"))
+	if err != nil {
+		log.Println("[deployRoute] Invalid selector:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	configmaps, _ := listConfigMapsByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(configmaps.Items), " template configmaps to copy.")
+	baselineNamespace := *argBaselineNamespace
+	if r.FormValue("baseline") != "" {
+		baselineNamespace = r.FormValue("baseline")
+	}
 
-	ingresses, _ := listIngresssByNamespace(*argTemplateNamespace)
-	log.Println("Found ", len(ingresses.Items), " template ingresses to copy.")
+	overlay := *argOverlay
+	if r.FormValue("overlay") != "" {
+		overlay = r.FormValue("overlay") == "true"
+	}
 
-	// create configmaps
-	for _, configmap := range configmaps.Items {
+	if err := validateOverlay(c, overlay, baselineNamespace); err != nil {
+		log.Println("[deployRoute]", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-		requestConfigMap := &v1.ConfigMap{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      configmap.Name,
-				Namespace: branchName,
-			},
-			Data: configmap.Data,
+	// reuse the overrides from the last deploy unless new ones were sent
+	if overrides == nil {
+		if ns, err := getNamespace(c.client, branchName); err == nil {
+			overrides = overridesFor(ns)
 		}
-
-		createConfigMap(branchName, requestConfigMap)
 	}
 
-	// create secrets
-	for _, secret := range secrets.Items {
-
-		// skip service accounts
-		if secret.Type != "kubernetes.io/service-account-token" {
-
-			requestSecret := &v1.Secret{
-				ObjectMeta: v1.ObjectMeta{
-					Name:      secret.Name,
-					Namespace: branchName,
-				},
-				Type: secret.Type,
-				Data: secret.Data,
-			}
-
-			createSecret(branchName, requestSecret)
-		}
+	// overridden images have to come from an image namespace the caller may deploy
+	overrideNamespaces, err := overrides.imageNamespaces(c)
+	for i := 0; err == nil && i < len(overrideNamespaces); i++ {
+		err = caller.allows(actionDeploy, c.Name, overrideNamespaces[i], branchName)
+	}
+	if err != nil {
+		log.Printf("[deployRoute] Refusing image override for %s: %v", caller.Name, err)
+		auditDenial(actionDeploy, caller.Name, c.Name, imageNamespace, branchName, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
 	}
 
-	// create services
-	for _, svc := range svcs.Items {
+	req := deployRequest{
+		Cluster:           c,
+		ImageNamespace:    imageNamespace,
+		BranchName:        branchName,
+		TemplateNamespace: templateNamespace,
+		Selector:          selector,
+		BaselineNamespace: baselineNamespace,
+		Overlay:           overlay,
+		Overrides:         overrides,
+		User:              caller.Name,
+	}
 
-		requestService := &v1.Service{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      svc.ObjectMeta.Name,
-				Namespace: branchName,
-			},
+	if dryRun {
+		format := r.FormValue("output")
+		if !validOutputFormat(format) {
+			log.Printf("[deployRoute] Unknown output format %q", format)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 
-		ports := []v1.ServicePort{}
-		for _, port := range svc.Spec.Ports {
-			newPort := v1.ServicePort{
-				Name:       port.Name,
-				Protocol:   port.Protocol,
-				Port:       port.Port,
-				TargetPort: port.TargetPort,
-			}
-
-			ports = append(ports, newPort)
+		plan, err := buildDeployPlan(req)
+		if err != nil {
+			log.Println("[deployRoute] Error reading template namespace:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
-		requestService.Spec.Ports = ports
-		requestService.Spec.Selector = svc.Spec.Selector
-		requestService.Spec.Type = svc.Spec.Type
-		requestService.Labels = svc.Labels
+		if format == outputYAML {
+			w.Header().Set("Content-Type", "application/x-yaml; charset=UTF-8")
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		}
 
-		createService(branchName, requestService)
+		w.WriteHeader(http.StatusOK)
+		if err := writeDeployPlan(w, plan, format); err != nil {
+			panic(err)
+		}
+		return
 	}
 
-	// now that we have all replicationControllers, update them to have new image name
-	for _, rc := range rcs.Items {
+	job := queue.enqueue(c, branchName, actionDeploy, caller.Name, func() jobResult {
+		return runDeploy(req)
+	})
+	writeJobResult(w, r, job)
+}
 
-		containerNameToUpdate := ""
+// runDeploy builds the plan for a deploy request and applies it
+func runDeploy(req deployRequest) (result jobResult) {
+	branchName := req.BranchName
+	_, err := getNamespace(req.Cluster.client, branchName)
+	existing := err == nil
+
+	entry := auditEntry{
+		Caller:         req.User,
+		Cluster:        req.Cluster.Name,
+		Action:         actionDeploy,
+		Branch:         branchName,
+		ImageNamespace: req.ImageNamespace,
+	}
+	if existing {
+		entry.Action = auditUpdate
+	}
 
-		// Looks for annotations to know which container to replace
-		for key, value := range rc.Annotations {
-			if key == "emmie-update" {
-				containerNameToUpdate = value
-			}
+	started := time.Now()
+	defer func() {
+		entry.Code = result.Code
+		entry.Duration = time.Since(started).String()
+		switch result.Code {
+		case http.StatusOK:
+			entry.Outcome = auditSucceeded
+		case http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+			entry.Outcome = auditRejected
+		default:
+			entry.Outcome = auditFailed
 		}
+		audit.record(entry)
+	}()
 
-		// Find the container which matches the annotation
-		for i, container := range rc.Spec.Template.Spec.Containers {
-
-			imageName := container.Image
-
-			if containerNameToUpdate == rc.Spec.Template.Spec.Containers[i].Name {
-				if *argsAWSRegistryID != "" {
-					// Check if image exists in ECR
-					imageTag := fmt.Sprintf("%s/%s", imageNamespace, rc.ObjectMeta.Name)
-					exists, err := imageTagExists(imageTag, branchName, *argAwsRegion, *argsAWSRegistryID)
-
-					if err != nil {
-						log.Println("Error looking up image tag in ECR: ", err)
-					}
-
-					// if the image tag exists, then update to use, otherwise default
-					if exists {
-						imageName = fmt.Sprintf("%s%s/%s:%s", *argDockerRegistry, imageNamespace, rc.ObjectMeta.Name, branchName)
-					}
-				} else {
-					imageName = fmt.Sprintf("%s%s/%s:%s", *argDockerRegistry, imageNamespace, rc.ObjectMeta.Name, branchName)
-				}
-			}
-
-			rc.Spec.Template.Spec.Containers[i].Image = imageName
+	plan, err := buildDeployPlan(req)
+	if err != nil {
+		log.Println("[runDeploy] Error reading template namespace:", err)
+		entry.Error = err.Error()
+		return jobResult{Code: http.StatusInternalServerError}
+	}
+	entry.Images = plan.Images
 
-			// Set the image pull policy to "Always"
-			rc.Spec.Template.Spec.Containers[i].ImagePullPolicy = "Always"
-		}
+	// placeholders which couldn't be expanded fail the deploy before anything is changed
+	if len(plan.Errors) > 0 {
+		log.Println("[runDeploy] Template errors:", strings.Join(plan.Errors, "; "))
+		entry.Error = strings.Join(plan.Errors, "; ")
+		return jobResult{Code: http.StatusUnprocessableEntity, Body: plan}
+	}
 
-		requestController := &v1.ReplicationController{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      rc.ObjectMeta.Name,
-				Namespace: branchName,
-			},
+	// new environments have to fit within the capacity limits
+	evicted := []string{}
+	if !existing {
+		evicted, err = admitEnvironment(plan, req.ImageNamespace)
+		if capErr, ok := err.(*capacityError); ok {
+			log.Println("[runDeploy] Rejecting deploy:", capErr)
+			entry.Error = capErr.Error()
+			return jobResult{Code: http.StatusTooManyRequests, Body: capErr.report}
+		} else if err != nil {
+			log.Println("[runDeploy] Error checking capacity:", err)
+			entry.Error = err.Error()
+			return jobResult{Code: http.StatusInternalServerError}
 		}
-
-		requestController.Spec = rc.Spec
-		requestController.Annotations = rc.Annotations
-		requestController.Spec.Replicas = defaultReplicaCount
-
-		// create new replication controller
-		createReplicationController(branchName, requestController)
 	}
 
-	// now that we have all deployments, update them to have new image name
-	for _, dply := range deployments.Items {
-
-		containerNameToUpdate := ""
+	status := startDeployStatus(plan)
+	status.Evicted = evicted
+	err = applyDeployPlan(plan, status)
+	status.finish(err)
 
-		// Looks for annotations to know which container to replace
-		for key, value := range dply.Annotations {
-			if key == "emmie-update" {
-				log.Printf("Container to update with emmie is: %s", value)
-				containerNameToUpdate = value
-			}
-		}
+	if err != nil {
+		log.Println("[runDeploy] Deploy failed:", err)
+		entry.Error = err.Error()
+		return jobResult{Code: http.StatusInternalServerError, Body: status.snapshot()}
+	}
 
-		// Find the container which matches the annotation
-		for i, container := range dply.Spec.Template.Spec.Containers {
+	log.Println("[Emmie] is finished deploying branch!")
+	return jobResult{Code: http.StatusOK, Body: status.snapshot()}
+}
 
-			imageName := container.Image
+// Delete (DELETE "/deploy")
+func deleteRoute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	branchName := vars["branchName"]
 
-			if containerNameToUpdate == dply.Spec.Template.Spec.Containers[i].Name {
+	// sanitize BranchName
+	branchName = sanitizeBranchName(branchName)
 
-				if *argsAWSRegistryID != "" {
-					// Check if image exists in ECR
-					imageTag := fmt.Sprintf("%s/%s", imageNamespace, dply.ObjectMeta.Name)
-					exists, err := imageTagExists(imageTag, branchName, *argAwsRegion, *argsAWSRegistryID)
+	c, ok := requestCluster(w, r)
+	if !ok {
+		return
+	}
 
-					if err != nil {
-						log.Println("Error looking up image tag in ECR: ", err)
-					}
+	caller, ok := authorize(w, r, actionDelete, c.Name, branchImageNamespace(c, branchName), branchName)
+	if !ok {
+		return
+	}
 
-					// if the image tag exists, then update to use, otherwise default
-					if exists {
-						log.Printf("Image tag found in ECR, updating image [%s] with tag [%s]", dply.ObjectMeta.Name, branchName)
-						imageName = fmt.Sprintf("%s%s/%s:%s", *argDockerRegistry, imageNamespace, dply.ObjectMeta.Name, branchName)
-					}
-				} else {
-					imageName = fmt.Sprintf("%s%s/%s:%s", *argDockerRegistry, imageNamespace, dply.ObjectMeta.Name, branchName)
-				}
-			}
+	log.Println("[Emmie] is deleting branch:", branchName, "for", caller.Name)
 
-			dply.Spec.Template.Spec.Containers[i].Image = imageName
+	force := r.FormValue("force") == "true"
 
-			// Set the image pull policy to "Always"
-			dply.Spec.Template.Spec.Containers[i].ImagePullPolicy = "Always"
-		}
+	job := queue.enqueue(c, branchName, actionDelete, caller.Name, func() jobResult {
+		status, err := deleteEnvironment(c, branchName, caller.Name, force)
 
-		deployment := &v1beta1.Deployment{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      dply.ObjectMeta.Name,
-				Namespace: branchName,
-			},
+		if err != nil {
+			log.Println("[deleteRoute] Not deleting branch:", err)
+			return jobResult{Code: http.StatusInternalServerError, Body: status.snapshot()}
 		}
 
-		deployment.Spec = dply.Spec
-		deployment.Annotations = dply.Annotations
-		deployment.Spec.Replicas = defaultReplicaCount
-
-		// create new deployment
-		createDeployment(branchName, deployment)
-	}
-
-	appendContainerToIngress := len(ingresses.Items) > 0
-	namespace := branchName
-
-	// create ingress
-	for _, ingress := range ingresses.Items {
-
-		rules := ingress.Spec.Rules
+		log.Println("[Emmie] is done deleting branch.")
+		return jobResult{Code: http.StatusOK, Body: status.snapshot()}
+	})
+	writeJobResult(w, r, job)
+}
 
-		// Found multiple ingresses, append ingress name to make unique
-		if appendContainerToIngress {
-			branchName = fmt.Sprintf("%s-%s", ingress.Name, namespace)
+// deleteEnvironment runs the pre-delete hooks of a branch and then removes
+// it, unless force is set a failed hook leaves the environment in place
+func deleteEnvironment(c *cluster, branchName, user string, force bool) (*deployStatus, error) {
+	status := &deployStatus{Cluster: c.Name, Branch: branchName, User: user, Started: time.Now()}
+	entry := auditEntry{Caller: user, Cluster: c.Name, Action: actionDelete, Branch: branchName}
+
+	templateNamespace := c.TemplateNamespace
+	if ns, err := getNamespace(c.client, branchName); err == nil {
+		templateNamespace = templateNamespaceFor(c, ns)
+		entry.ImageNamespace = ns.Annotations[imageNamespaceAnnotation]
+
+		// give pre-delete hooks a chance to export anything worth keeping
+		hooks, err := preDeleteHooks(c, ns)
+		if err == nil {
+			err = runHooks(c.client, branchName, hookPreDelete, hooks, status)
 		}
 
-		rules[0].Host = fmt.Sprintf("%s.%s", branchName, *argSubDomain)
+		if err != nil && !force {
+			err = fmt.Errorf("pre-delete hooks failed: %v", err)
+			status.finish(err)
 
-		requestIngress := &v1beta1.Ingress{
-			ObjectMeta: v1.ObjectMeta{
-				Name:      ingress.Name,
-				Namespace: namespace,
-			},
-			Spec: v1beta1.IngressSpec{
-				Rules: rules,
-			},
+			entry.Outcome = auditFailed
+			entry.Error = err.Error()
+			entry.Duration = time.Since(status.Started).String()
+			audit.record(entry)
+			return status, err
 		}
 
-		createIngress(namespace, requestIngress)
+		// record who deleted the environment while the namespace terminates
+		if ns.Annotations == nil {
+			ns.Annotations = make(map[string]string)
+		}
+		ns.Annotations[deletedByAnnotation] = user
+		if err := updateNamespace(c.client, ns); err != nil {
+			log.Println("[deleteEnvironment] Error recording who deleted the namespace:", err)
+		}
 	}
 
-	log.Println("[Emmie] is finished deploying branch!")
-}
+	deleteAllObjects(c, branchName, templateNamespace)
+	deleteNamespace(c.client, branchName)
+	status.finish(nil)
 
-// Delete (DELETE "/deploy")
-func deleteRoute(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	branchName := vars["branchName"]
-	log.Println("[Emmie] is deleting branch:", branchName)
-
-	if !tokenIsValid(r.FormValue("token")) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	// sanitize BranchName
-	branchName = strings.Replace(branchName, "_", "-", -1)
+	entry.Outcome = auditSucceeded
+	entry.Duration = time.Since(status.Started).String()
+	audit.record(entry)
 
-	deleteAllObjects(branchName)
-	deleteNamespace(branchName)
-	log.Println("[Emmie] is done deleting branch.")
+	return status, nil
 }
 
-// Deletes everything but the namespace
-func deleteAllObjects(branchName string) {
+// Deletes everything but the namespace, using templateNamespace to find what was created
+func deleteAllObjects(c *cluster, branchName, templateNamespace string) {
+	client := c.client
+
 	// get controllers / services / secrets in namespace
-	rcs, _ := listReplicationControllersByNamespace(*argTemplateNamespace)
+	rcs, _ := listReplicationControllersByNamespace(client, templateNamespace)
+	deployments, _ := listDeploymentsByNamespace(client, templateNamespace)
+
+	// remove workloads in the reverse of the order they were created
+	deps := map[string][]string{}
 	for _, rc := range rcs.Items {
-		deleteReplicationController(branchName, rc.ObjectMeta.Name)
-		log.Println("Deleted replicationController:", rc.ObjectMeta.Name)
+		deps[rc.Name] = dependsOn(rc.Annotations)
 	}
-
-	deployments, _ := listDeploymentsByNamespace(*argTemplateNamespace)
 	for _, dply := range deployments.Items {
-		deleteDeployment(branchName, dply.ObjectMeta.Name)
-		log.Println("Deleted deployment:", dply.ObjectMeta.Name)
+		deps[dply.Name] = dependsOn(dply.Annotations)
+	}
+
+	layers, err := dependencyLayers(deps)
+	if err != nil {
+		log.Println("[deleteAllObjects] Ignoring dependencies:", err)
+		all := []string{}
+		for name := range deps {
+			all = append(all, name)
+		}
+		layers = [][]string{all}
 	}
 
-	svcs, _ := listServicesByNamespace(*argTemplateNamespace)
+	for i := len(layers) - 1; i >= 0; i-- {
+		for _, rc := range rcs.Items {
+			if inLayer(layers[i], rc.Name) {
+				deleteReplicationController(client, branchName, rc.ObjectMeta.Name)
+				log.Println("Deleted replicationController:", rc.ObjectMeta.Name)
+			}
+		}
+
+		for _, dply := range deployments.Items {
+			if inLayer(layers[i], dply.Name) {
+				deleteDeployment(client, branchName, dply.ObjectMeta.Name)
+				log.Println("Deleted deployment:", dply.ObjectMeta.Name)
+			}
+		}
+	}
+
+	svcs, _ := listServicesByNamespace(client, templateNamespace)
 	for _, svc := range svcs.Items {
-		deleteService(branchName, svc.ObjectMeta.Name)
+		deleteService(client, branchName, svc.ObjectMeta.Name)
 		log.Println("Deleted service:", svc.ObjectMeta.Name)
 	}
 
-	secrets, _ := listSecretsByNamespace(*argTemplateNamespace)
+	secrets, _ := listSecretsByNamespace(client, templateNamespace)
 	for _, secret := range secrets.Items {
-		deleteSecret(branchName, secret.ObjectMeta.Name)
+		deleteSecret(client, branchName, secret.ObjectMeta.Name)
 		log.Println("Deleted secret:", secret.ObjectMeta.Name)
 	}
 
-	configmaps, _ := listConfigMapsByNamespace(*argTemplateNamespace)
+	configmaps, _ := listConfigMapsByNamespace(client, templateNamespace)
 	for _, configmap := range configmaps.Items {
-		deleteSecret(branchName, configmap.ObjectMeta.Name)
+		deleteConfigMap(client, branchName, configmap.ObjectMeta.Name)
 		log.Println("Deleted configmap:", configmap.ObjectMeta.Name)
 	}
 
-	ingresses, _ := listIngresssByNamespace(*argTemplateNamespace)
+	ingresses, _ := listIngresssByNamespace(client, templateNamespace)
 	for _, ingress := range ingresses.Items {
-		deleteIngress(branchName, ingress.ObjectMeta.Name)
+		deleteIngress(client, branchName, ingress.ObjectMeta.Name)
 		log.Println("Deleted ingress:", ingress.ObjectMeta.Name)
 	}
+
+	jobs, _ := listJobsByNamespace(client, templateNamespace)
+	for _, job := range jobs.Items {
+		if job.Annotations[hookAnnotation] != "" {
+			deleteJob(client, branchName, job.ObjectMeta.Name)
+			log.Println("Deleted hook job:", job.ObjectMeta.Name)
+		}
+	}
+}
+
+// sanitizeBranchName makes a branch name usable as a namespace
+func sanitizeBranchName(branchName string) string {
+	return strings.Replace(branchName, "_", "-", -1)
 }
 
-func tokenIsValid(token string) bool {
-	// If no path is passed, then auth is disabled
-	if *argPathToTokens == "" {
-		return true
+func main() {
+	flag.Parse()
+	log.Println("[Emmie] is up and running!", time.Now())
+
+	// A dry run renders a plan without serving anything
+	if !*argDryRun {
+		if err := checkTLSFlags(); err != nil {
+			log.Fatal("[Emmie] ", err)
+		}
 	}
 
-	file, err := os.Open(*argPathToTokens)
-	if err != nil {
+	if err := loadQuotaConfig(); err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		if token == scanner.Text() {
-			fmt.Println("Token IS valid!")
-			return true
-		}
+	if *argEvictionPolicy != evictNone && *argEvictionPolicy != evictOldest && *argEvictionPolicy != evictLeastRecentUse {
+		log.Fatalf("Unknown eviction-policy %q", *argEvictionPolicy)
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	queue = newDeployQueue(*argDeployWorkers)
+
+	if *argAuditHistory < 0 {
+		log.Fatal("[Emmie] audit-history must not be negative")
 	}
+	auditLog, err := newAuditLog(*argAuditLog, *argAuditHistory)
+	if err != nil {
+		log.Fatal("[Emmie] Error opening audit log: ", err)
+	}
+	audit = auditLog
 
-	fmt.Println("Token is NOT valid! =(")
-	return false
-}
+	if *argPathToTokens != "" {
+		tokens = newTokenStore(*argPathToTokens)
+		go tokens.watch(*argTokensReload)
+	}
 
-func main() {
-	flag.Parse()
-	log.Println("[Emmie] is up and running!", time.Now())
+	if *argOIDCIssuer != "" {
+		// without an audience any token the issuer signs for another client would be accepted
+		if *argOIDCAudience == "" {
+			log.Fatal("[Emmie] oidc-audience is required with oidc-issuer")
+		}
 
-	// Sanitize docker registry
-	if *argDockerRegistry != "" {
-		*argDockerRegistry = fmt.Sprintf("%s/", *argDockerRegistry)
+		verifier, err := newOIDCVerifier(*argOIDCIssuer, *argOIDCAudience, *argOIDCJWKSURL, *argOIDCGroups)
+		if err != nil {
+			log.Fatal("[Emmie] Invalid oidc groups: ", err)
+		}
+		oidc = verifier
 	}
 
 	// Configure router
@@ -440,6 +544,12 @@ func main() {
 	router.HandleFunc("/deploy/{namespace}/{branchName}", deployRoute).Methods("POST")
 	router.HandleFunc("/deploy/{branchName}", deleteRoute).Methods("DELETE")
 	router.HandleFunc("/deploy", getDeploymentsRoute).Methods("GET")
+	router.HandleFunc("/deploy/{branchName}/manifests", getManifestsRoute).Methods("GET")
+	router.HandleFunc("/deploy/{branchName}/status", getDeployStatusRoute).Methods("GET")
+	router.HandleFunc("/capacity", capacityRoute).Methods("GET")
+	router.HandleFunc("/queue", queueRoute).Methods("GET")
+	router.HandleFunc("/audit", auditRoute).Methods("GET")
+	router.HandleFunc("/metrics", metricsRoute).Methods("GET")
 
 	// Services
 	// router.HandleFunc("/services/{namespace}/{serviceName}", getServiceRoute).Methods("GET")
@@ -456,22 +566,71 @@ func main() {
 	// Version
 	router.HandleFunc("/version", versionRoute)
 
-	// Create k8s client
-	config, err := rest.InClusterConfig()
-	//config, err := clientcmd.BuildConfigFromFlags("", *argKubecfgFile)
-	if err != nil {
-		panic(err.Error())
+	// Create k8s clients
+	if err := loadClusters(*argClusters); err != nil {
+		log.Fatal("[Emmie] Error configuring kubernetes clients: ", err)
 	}
 
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
+	// Render a deploy plan and exit without touching the cluster
+	if *argDryRun {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: emmie --dry-run [--output=json|yaml] <namespace> <branchName>")
+		}
+		if !validOutputFormat(*argOutputFormat) {
+			log.Fatalf("Unknown output format %q", *argOutputFormat)
+		}
+
+		selector, err := labels.Parse(*argSelector)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := validateOverlay(defaultCluster, *argOverlay, *argBaselineNamespace); err != nil {
+			log.Fatal(err)
+		}
+
+		var overrides *deployOverrides
+		if *argOverridesFile != "" {
+			data, err := ioutil.ReadFile(*argOverridesFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			overrides, err = parseOverrides(data)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		plan, err := buildDeployPlan(deployRequest{
+			Cluster:           defaultCluster,
+			ImageNamespace:    flag.Arg(0),
+			BranchName:        sanitizeBranchName(flag.Arg(1)),
+			TemplateNamespace: defaultCluster.TemplateNamespace,
+			Selector:          selector,
+			BaselineNamespace: *argBaselineNamespace,
+			Overlay:           *argOverlay,
+			Overrides:         overrides,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := writeDeployPlan(os.Stdout, plan, *argOutputFormat); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	client = clientset
+	var handler http.Handler = router
+	if *argRateLimit > 0 {
+		if *argRateBurst < 1 || (*argDestructiveRate > 0 && *argDestructiveBurst < 1) {
+			log.Fatal("[Emmie] rate-burst and destructive-burst must be at least 1")
+		}
+		limiter = newRateLimiter()
+		handler = limiter.limit(router)
+	}
 
 	// Start server
-	log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", *argListenPort), "certs/cert.pem", "certs/key.pem", router))
-	//log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *argListenPort), router))
+	log.Fatal(serve(handler))
 }
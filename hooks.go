@@ -0,0 +1,383 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	apierrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+)
+
+// annotations on template jobs which make them hooks
+const (
+	hookAnnotation       = "emmie-hook"
+	hookWeightAnnotation = "emmie-hook-weight"
+)
+
+// phases a hook can run in
+const (
+	hookPreDeploy  = "pre-deploy"
+	hookPostDeploy = "post-deploy"
+	hookPreDelete  = "pre-delete"
+)
+
+// how often hooks and workloads are checked while waiting on them
+const hookPollInterval = 2 * time.Second
+
+// most log output kept for each hook
+const maxHookLogBytes = 16 * 1024
+
+// hookResult is the outcome of running a single hook job
+type hookResult struct {
+	Name      string    `json:"name"`
+	Phase     string    `json:"phase"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+	Logs      string    `json:"logs,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// hooksForPhase returns the hooks to run in a phase, ordered by their weight
+// and then by name
+func hooksForPhase(hooks []*batchv1.Job, phase string) []*batchv1.Job {
+	selected := []*batchv1.Job{}
+	for _, hook := range hooks {
+		if hook.Annotations[hookAnnotation] == phase {
+			selected = append(selected, hook)
+		}
+	}
+
+	sort.Sort(hooksByWeight(selected))
+	return selected
+}
+
+// hooksByWeight sorts hooks by weight and then by name
+type hooksByWeight []*batchv1.Job
+
+func (h hooksByWeight) Len() int      { return len(h) }
+func (h hooksByWeight) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hooksByWeight) Less(i, j int) bool {
+	wi, wj := hookWeight(h[i]), hookWeight(h[j])
+	if wi != wj {
+		return wi < wj
+	}
+	return h[i].Name < h[j].Name
+}
+
+// hookWeight reads the emmie-hook-weight annotation, defaulting to 0
+func hookWeight(hook *batchv1.Job) int {
+	weight, err := strconv.Atoi(hook.Annotations[hookWeightAnnotation])
+	if err != nil {
+		return 0
+	}
+	return weight
+}
+
+// hookJob copies a template job for a branch, dropping the selector and labels
+// the api server generated for the template
+func hookJob(job batchv1.Job, namespace string) *batchv1.Job {
+	hook := &batchv1.Job{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        job.Name,
+			Namespace:   namespace,
+			Labels:      withoutJobLabels(job.Labels),
+			Annotations: job.Annotations,
+		},
+		Spec: job.Spec,
+	}
+	hook.Kind = "Job"
+	hook.APIVersion = "batch/v1"
+
+	hook.Spec.Selector = nil
+	hook.Spec.ManualSelector = nil
+
+	hook.Spec.Template.Labels = withoutJobLabels(job.Spec.Template.Labels)
+
+	return hook
+}
+
+// withoutJobLabels copies labels leaving out the ones the api server sets to
+// tie a job to its pods
+func withoutJobLabels(labels map[string]string) map[string]string {
+	copied := map[string]string{}
+	for key, value := range labels {
+		if key != "controller-uid" && key != "job-name" {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+// preDeleteHooks renders the pre-delete hooks of the template a branch
+// namespace was cloned from
+func preDeleteHooks(c *cluster, ns *v1.Namespace) ([]*batchv1.Job, error) {
+	templateNamespace := templateNamespaceFor(c, ns)
+
+	jobs, err := listJobsByNamespace(c.client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	req := deployRequest{
+		Cluster:           c,
+		ImageNamespace:    ns.Annotations[imageNamespaceAnnotation],
+		BranchName:        ns.Name,
+		TemplateNamespace: templateNamespace,
+	}
+	plan := &deployPlan{Cluster: c.Name, Namespace: ns.Name, cluster: c}
+	sub := newSubstituter(c, req.BranchName, req.ImageNamespace, templateNamespace)
+
+	hooks := []*batchv1.Job{}
+	for _, job := range jobs.Items {
+		if job.Annotations[hookAnnotation] == hookPreDelete {
+			hooks = append(hooks, plan.renderHook(req, sub, job))
+		}
+	}
+
+	if len(sub.errors) > 0 {
+		return nil, fmt.Errorf("template errors: %v", sub.errors)
+	}
+
+	return hooks, nil
+}
+
+// runHooks runs each hook of a phase in order, stopping at the first failure
+func runHooks(client *kubernetes.Clientset, namespace, phase string, hooks []*batchv1.Job, status *deployStatus) error {
+	for _, hook := range hooksForPhase(hooks, phase) {
+		log.Printf("Running %s hook: %s", phase, hook.Name)
+
+		result := runHook(client, namespace, phase, hook, *argHookTimeout)
+		if status != nil {
+			status.addHook(result)
+		}
+
+		if !result.Succeeded {
+			return fmt.Errorf("%s hook %s failed: %s", phase, hook.Name, result.Error)
+		}
+	}
+
+	return nil
+}
+
+// runHook creates a hook job and waits for it to complete or fail
+func runHook(client *kubernetes.Clientset, namespace, phase string, hook *batchv1.Job, timeout time.Duration) hookResult {
+	result := hookResult{
+		Name:    hook.Name,
+		Phase:   phase,
+		Started: time.Now(),
+	}
+
+	// clear out the job from any previous run, a job of the same name can't
+	// be created while the old one is still being deleted
+	if _, err := client.Batch().Jobs(namespace).Get(hook.Name); err == nil {
+		removeHookJob(client, namespace, hook.Name)
+		if err := waitForJobGone(client, namespace, hook.Name, timeout); err != nil {
+			result.Error = err.Error()
+			result.Finished = time.Now()
+			return result
+		}
+	}
+
+	if err := createJob(client, namespace, hook); err != nil {
+		result.Error = err.Error()
+		result.Finished = time.Now()
+		return result
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := getJob(client, hook.Name, namespace)
+
+		if err == nil && job.Status.Succeeded > 0 {
+			result.Succeeded = true
+			break
+		}
+
+		if err == nil && (job.Status.Failed > 0 || jobConditionTrue(job, batchv1.JobFailed)) {
+			result.Error = "job failed"
+			break
+		}
+
+		if time.Now().After(deadline) {
+			result.Error = fmt.Sprintf("timed out after %s", timeout)
+			break
+		}
+
+		time.Sleep(hookPollInterval)
+	}
+
+	result.Logs = jobLogs(client, namespace, hook.Name)
+	result.Finished = time.Now()
+
+	// stop a failed job from retrying and a hung one from running on
+	if !result.Succeeded {
+		removeHookJob(client, namespace, hook.Name)
+	}
+
+	return result
+}
+
+// jobConditionTrue checks whether a job has a condition set
+func jobConditionTrue(job *batchv1.Job, conditionType batchv1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// jobLogs collects the logs of the pods a job ran, truncated to the most recent output
+func jobLogs(client *kubernetes.Clientset, namespace, jobName string) string {
+	pods, err := listJobPods(client, namespace, jobName)
+	if err != nil {
+		return ""
+	}
+
+	logs := ""
+	for _, pod := range pods.Items {
+		raw, err := client.Core().Pods(namespace).GetLogs(pod.Name, &v1.PodLogOptions{}).Do().Raw()
+		if err != nil {
+			log.Println("[jobLogs] Error getting logs for pod", pod.Name, err)
+			continue
+		}
+		logs += string(raw)
+	}
+
+	if len(logs) > maxHookLogBytes {
+		logs = logs[len(logs)-maxHookLogBytes:]
+	}
+
+	return logs
+}
+
+// removeHookJob deletes a hook job and its pods, deleting the job alone
+// leaves its pods running
+func removeHookJob(client *kubernetes.Clientset, namespace, jobName string) {
+	deleteJob(client, namespace, jobName)
+	deleteJobPods(client, namespace, jobName)
+}
+
+// waitForJobGone waits until a deleted job and its pods have been removed
+func waitForJobGone(client *kubernetes.Clientset, namespace, jobName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if _, err := client.Batch().Jobs(namespace).Get(jobName); apierrors.IsNotFound(err) {
+			pods, err := listJobPods(client, namespace, jobName)
+			if err == nil && len(pods.Items) == 0 {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("previous run of %s still being deleted after %s", jobName, timeout)
+		}
+
+		time.Sleep(hookPollInterval)
+	}
+}
+
+// deleteJobPods removes the pods left behind by a job
+func deleteJobPods(client *kubernetes.Clientset, namespace, jobName string) {
+	pods, err := listJobPods(client, namespace, jobName)
+	if err != nil {
+		return
+	}
+
+	for _, pod := range pods.Items {
+		deletePod(client, namespace, pod.Name)
+	}
+}
+
+// waitForWorkloads waits until the named workloads in the plan have their
+// replicas ready, nil names waits on every workload
+func waitForWorkloads(plan *deployPlan, names []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pending := pendingWorkloads(plan, names)
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("workloads not ready after %s: %v", timeout, pending)
+		}
+
+		time.Sleep(hookPollInterval)
+	}
+}
+
+// pendingWorkloads lists the named workloads in the plan which aren't ready yet
+func pendingWorkloads(plan *deployPlan, names []string) []string {
+	pending := []string{}
+	client := plan.cluster.client
+
+	for _, rc := range plan.ReplicationControllers {
+		if names != nil && !contains(names, rc.Name) {
+			continue
+		}
+
+		current, err := getReplicationController(client, rc.Name, plan.Namespace)
+		if err != nil || current.Status.ReadyReplicas < desiredReplicas(current.Spec.Replicas) {
+			pending = append(pending, "ReplicationController/"+rc.Name)
+		}
+	}
+
+	for _, deployment := range plan.Deployments {
+		if names != nil && !contains(names, deployment.Name) {
+			continue
+		}
+
+		current, err := getDeployment(client, deployment.Name, plan.Namespace)
+		if err != nil ||
+			current.Status.ObservedGeneration < current.Generation ||
+			current.Status.UpdatedReplicas < desiredReplicas(current.Spec.Replicas) ||
+			current.Status.AvailableReplicas < desiredReplicas(current.Spec.Replicas) {
+			pending = append(pending, "Deployment/"+deployment.Name)
+		}
+	}
+
+	return pending
+}
+
+// desiredReplicas reads a replica count, nil means the default of one
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
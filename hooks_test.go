@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+)
+
+func TestHookJobDropsGeneratedLabels(t *testing.T) {
+	generated := map[string]string{"app": "migrate", "controller-uid": "1234", "job-name": "migrate"}
+
+	job := batchv1.Job{
+		ObjectMeta: v1.ObjectMeta{Name: "migrate", Namespace: "template", Labels: generated},
+		Spec: batchv1.JobSpec{
+			Template: v1.PodTemplateSpec{ObjectMeta: v1.ObjectMeta{Labels: generated}},
+		},
+	}
+
+	hook := hookJob(job, "feature-x")
+
+	for name, labels := range map[string]map[string]string{"job": hook.Labels, "pod template": hook.Spec.Template.Labels} {
+		if len(labels) != 1 || labels["app"] != "migrate" {
+			t.Errorf("%s labels = %v, want only app=migrate", name, labels)
+		}
+	}
+	if hook.Namespace != "feature-x" || hook.Spec.Selector != nil {
+		t.Errorf("hook = %+v, want it in feature-x without a selector", hook.ObjectMeta)
+	}
+	if len(job.Labels) != 3 {
+		t.Errorf("template job labels changed to %v", job.Labels)
+	}
+}
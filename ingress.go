@@ -33,6 +33,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -44,7 +45,7 @@ func getIngressRoute(w http.ResponseWriter, r *http.Request) {
 	ingressName := vars["IngressName"]
 	namespace := vars["namespace"]
 
-	rc, err := getIngress(ingressName, namespace)
+	rc, err := getIngress(defaultCluster.client, ingressName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +65,7 @@ func getIngresssRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	rc, err := listIngresss(namespace, key, value)
+	rc, err := listIngresss(defaultCluster.client, namespace, key, value)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +83,7 @@ func getIngresssRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listIngresssByNamespace(namespace string) (*v1beta1.IngressList, error) {
+func listIngresssByNamespace(client *kubernetes.Clientset, namespace string) (*v1beta1.IngressList, error) {
 	list, err := client.Ingresses(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -92,7 +93,7 @@ func listIngresssByNamespace(namespace string) (*v1beta1.IngressList, error) {
 	return list, nil
 }
 
-func listIngresss(namespace, labelKey, labelValue string) (*v1beta1.IngressList, error) {
+func listIngresss(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1beta1.IngressList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Ingresses(namespace).List(listOptions)
@@ -104,7 +105,7 @@ func listIngresss(namespace, labelKey, labelValue string) (*v1beta1.IngressList,
 	return list, nil
 }
 
-func getIngress(IngressName, namespace string) (*v1beta1.Ingress, error) {
+func getIngress(client *kubernetes.Clientset, IngressName, namespace string) (*v1beta1.Ingress, error) {
 	rc, err := client.Ingresses(namespace).Get(IngressName)
 
 	if err != nil {
@@ -114,7 +115,7 @@ func getIngress(IngressName, namespace string) (*v1beta1.Ingress, error) {
 	return rc, nil
 }
 
-func createIngress(namespace string, rc *v1beta1.Ingress) error {
+func createIngress(client *kubernetes.Clientset, namespace string, rc *v1beta1.Ingress) error {
 	_, err := client.Ingresses(namespace).Create(rc)
 
 	if err != nil {
@@ -123,7 +124,7 @@ func createIngress(namespace string, rc *v1beta1.Ingress) error {
 	return err
 }
 
-func deleteIngress(namespace, name string) error {
+func deleteIngress(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: Use nil?
 	err := client.Ingresses(namespace).Delete(name, nil)
 
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+	"k8s.io/client-go/1.4/pkg/fields"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+func listJobsByNamespace(client *kubernetes.Clientset, namespace string) (*batchv1.JobList, error) {
+	list, err := client.Batch().Jobs(namespace).List(api.ListOptions{})
+
+	if err != nil {
+		log.Println("[listJobsByNamespace] Error listing Jobs", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+func getJob(client *kubernetes.Clientset, jobName, namespace string) (*batchv1.Job, error) {
+	job, err := client.Batch().Jobs(namespace).Get(jobName)
+
+	if err != nil {
+		log.Println("[getJob] Error getting Job", err)
+		return nil, err
+	}
+	return job, nil
+}
+
+func createJob(client *kubernetes.Clientset, namespace string, job *batchv1.Job) error {
+	_, err := client.Batch().Jobs(namespace).Create(job)
+
+	if err != nil {
+		log.Println("[createJob] Error creating Job:", err)
+	}
+	return err
+}
+
+func deleteJob(client *kubernetes.Clientset, namespace, name string) error {
+	err := client.Batch().Jobs(namespace).Delete(name, nil)
+
+	if err != nil {
+		log.Println("[deleteJob] Error deleting Job:", err)
+	}
+	return err
+}
+
+// listJobPods lists the pods created for a job
+func listJobPods(client *kubernetes.Clientset, namespace, jobName string) (*v1.PodList, error) {
+	selector := labels.Set{"job-name": jobName}.AsSelector()
+	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
+	list, err := client.Core().Pods(namespace).List(listOptions)
+
+	if err != nil {
+		log.Println("[listJobPods] Error listing pods for Job", err)
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	authorizationapi "k8s.io/client-go/1.4/pkg/apis/authorization/v1beta1"
+)
+
+// how long a successful token review is trusted before the token is reviewed again
+const tokenReviewTTL = time.Minute
+
+// how long a refused token is refused without asking the cluster again, so
+// retries with a bad token don't each cost a TokenReview
+const tokenRefusalTTL = 10 * time.Second
+
+// the TokenReview api isn't part of the vendored client, so reviews are sent as raw json
+const tokenReviewPath = "/apis/authentication.k8s.io/v1beta1/tokenreviews"
+
+// tokenReview is a TokenReview request and response
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          kubeUser `json:"user,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// kubeUser is a user authenticated by the cluster, whose permissions are
+// decided by SubjectAccessReviews
+type kubeUser struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// cachedReview is a reviewed token, the user it belongs to or why it was
+// refused, and when the review stops being trusted
+type cachedReview struct {
+	user    kubeUser
+	err     error
+	expires time.Time
+}
+
+// reviewed tokens, keyed by the hash of the token
+var tokenReviews = struct {
+	sync.Mutex
+	byHash map[[sha256.Size]byte]cachedReview
+}{byHash: make(map[[sha256.Size]byte]cachedReview)}
+
+// reviewToken asks the cluster who a bearer token belongs to
+func reviewToken(token string) (*identity, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	tokenReviews.Lock()
+	cached, ok := tokenReviews.byHash[hash]
+	tokenReviews.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		return kubeIdentity(cached.user), nil
+	}
+
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1beta1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := defaultCluster.client.Core().GetRESTClient().Post().
+		AbsPath(tokenReviewPath).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	if err != nil {
+		return nil, fmt.Errorf("token review failed: %v", err)
+	}
+
+	review := tokenReview{}
+	if err := json.Unmarshal(data, &review); err != nil {
+		return nil, fmt.Errorf("token review failed: %v", err)
+	}
+	if !review.Status.Authenticated {
+		err := fmt.Errorf("token not authenticated")
+		if review.Status.Error != "" {
+			err = fmt.Errorf("token not authenticated: %s", review.Status.Error)
+		}
+		cacheReview(hash, cachedReview{err: err, expires: time.Now().Add(tokenRefusalTTL)})
+		return nil, err
+	}
+
+	cacheReview(hash, cachedReview{user: review.Status.User, expires: time.Now().Add(tokenReviewTTL)})
+	return kubeIdentity(review.Status.User), nil
+}
+
+// cacheReview stores the review of a token and drops expired reviews
+func cacheReview(hash [sha256.Size]byte, review cachedReview) {
+	tokenReviews.Lock()
+	defer tokenReviews.Unlock()
+
+	for key, entry := range tokenReviews.byHash {
+		if time.Now().After(entry.expires) {
+			delete(tokenReviews.byHash, key)
+		}
+	}
+	tokenReviews.byHash[hash] = review
+}
+
+// kubeIdentity is the caller for a user authenticated by the cluster
+func kubeIdentity(user kubeUser) *identity {
+	return &identity{Name: user.Username, kube: &user}
+}
+
+// allows asks the cluster an environment is in whether the user may take an
+// action on it, checked as the verb on the environments resource of the
+// kube-auth-group api group, named after the branch, with the image namespace
+// as its subresource so roles can be limited to environments/{namespace}. The
+// cluster's name is the namespace of the review, so a role bound in a
+// namespace of that name only applies to that cluster
+func (u *kubeUser) allows(action, clusterName, imageNamespace, branchName string) error {
+	c, err := clusterNamed(clusterName)
+	if err != nil {
+		return err
+	}
+
+	extra := map[string]authorizationapi.ExtraValue{}
+	for key, values := range u.Extra {
+		extra[key] = authorizationapi.ExtraValue(values)
+	}
+
+	review, err := c.client.Authorization().SubjectAccessReviews().Create(&authorizationapi.SubjectAccessReview{
+		Spec: authorizationapi.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationapi.ResourceAttributes{
+				Namespace:   clusterName,
+				Group:       *argKubeAuthGroup,
+				Resource:    "environments",
+				Subresource: imageNamespace,
+				Name:        branchName,
+				Verb:        action,
+			},
+			User:   u.Username,
+			Groups: u.Groups,
+			Extra:  extra,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("subject access review failed: %v", err)
+	}
+
+	if !review.Status.Allowed {
+		if review.Status.Reason != "" {
+			return fmt.Errorf("%s not allowed: %s", action, review.Status.Reason)
+		}
+		return fmt.Errorf("%s not allowed", action)
+	}
+	return nil
+}
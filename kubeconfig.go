@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"k8s.io/client-go/1.4/rest"
+	"k8s.io/client-go/1.4/tools/clientcmd"
+)
+
+// kubeConfig works out how to reach the cluster: the in-cluster service
+// account when no kubeconfig, context or master url is given (falling back
+// to $KUBECONFIG or ~/.kube/config outside a pod), and otherwise the
+// kubeconfig with the context and master url applied on top. It also
+// describes the cluster for the startup log.
+func kubeConfig(kubeconfigPath, context, masterURL string) (*rest.Config, string, error) {
+	if kubeconfigPath == "" && context == "" && masterURL == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, fmt.Sprintf("%s (in-cluster service account)", config.Host), nil
+		}
+		log.Println("[kubeConfig] Not running in a cluster, using the default kubeconfig:", err)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfigPath
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	overrides.ClusterInfo.Server = os.ExpandEnv(masterURL)
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	source := "default kubeconfig"
+	if kubeconfigPath != "" {
+		source = kubeconfigPath
+	}
+	if raw, err := clientConfig.RawConfig(); err == nil {
+		if context == "" {
+			context = raw.CurrentContext
+		}
+		if context != "" {
+			source = fmt.Sprintf("context %s of %s", context, source)
+		}
+	}
+	if masterURL != "" {
+		source = fmt.Sprintf("%s, master url overridden", source)
+	}
+
+	return config, fmt.Sprintf("%s (%s)", config.Host, source), nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/ghodss/yaml"
+	"github.com/gorilla/mux"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+)
+
+// metadata fields set by the api server which can't be sent back on create
+var serverMetadataFields = []string{
+	"namespace",
+	"selfLink",
+	"uid",
+	"resourceVersion",
+	"generation",
+	"creationTimestamp",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+	"ownerReferences",
+	"finalizers",
+}
+
+// annotations added by controllers which don't belong in a manifest
+var serverAnnotations = []string{
+	"deployment.kubernetes.io/revision",
+}
+
+// Manifests (GET "/deploy/branchName/manifests")
+func getManifestsRoute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	branchName := vars["branchName"]
+
+	// sanitize BranchName
+	branchName = sanitizeBranchName(branchName)
+
+	c, ok := requestCluster(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := authorize(w, r, actionRead, c.Name, branchImageNamespace(c, branchName), branchName); !ok {
+		return
+	}
+
+	ns, err := getNamespace(c.client, branchName)
+	if err != nil || ns.Labels["deployedBy"] != "emmie" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	manifests, err := exportManifests(c.client, branchName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := writeManifests(w, manifests); err != nil {
+		panic(err)
+	}
+}
+
+// exportManifests collects every object emmie manages in a namespace with
+// the fields set by the cluster removed
+func exportManifests(client *kubernetes.Clientset, namespace string) ([]map[string]interface{}, error) {
+	objects := []interface{}{}
+
+	configmaps, err := listConfigMapsByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := range configmaps.Items {
+		configmaps.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"}
+		objects = append(objects, configmaps.Items[i])
+	}
+
+	secrets, err := listSecretsByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i, secret := range secrets.Items {
+		// skip service accounts
+		if secret.Type == "kubernetes.io/service-account-token" {
+			continue
+		}
+		secrets.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "Secret", APIVersion: "v1"}
+		objects = append(objects, redactSecret(secrets.Items[i]))
+	}
+
+	svcs, err := listServicesByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := range svcs.Items {
+		svcs.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "Service", APIVersion: "v1"}
+		svcs.Items[i].Spec.ClusterIP = ""
+		objects = append(objects, svcs.Items[i])
+	}
+
+	rcs, err := listReplicationControllersByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rcs.Items {
+		rcs.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "ReplicationController", APIVersion: "v1"}
+		objects = append(objects, rcs.Items[i])
+	}
+
+	deployments, err := listDeploymentsByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deployments.Items {
+		deployments.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "Deployment", APIVersion: "extensions/v1beta1"}
+		objects = append(objects, deployments.Items[i])
+	}
+
+	ingresses, err := listIngresssByNamespace(client, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ingresses.Items {
+		ingresses.Items[i].TypeMeta = unversioned.TypeMeta{Kind: "Ingress", APIVersion: "extensions/v1beta1"}
+		objects = append(objects, ingresses.Items[i])
+	}
+
+	manifests := []map[string]interface{}{}
+	for _, obj := range objects {
+		manifest, err := stripServerFields(obj)
+		if err != nil {
+			log.Println("[exportManifests] Error stripping server fields", err)
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests, nil
+}
+
+// stripServerFields converts an object to a generic map and drops its status
+// and any metadata owned by the api server
+func stripServerFields(obj interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	delete(manifest, "status")
+
+	if metadata, ok := manifest["metadata"].(map[string]interface{}); ok {
+		for _, field := range serverMetadataFields {
+			delete(metadata, field)
+		}
+
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			for _, annotation := range serverAnnotations {
+				delete(annotations, annotation)
+			}
+			if len(annotations) == 0 {
+				delete(metadata, "annotations")
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// writeManifests writes the manifests as a multi-document yaml stream
+func writeManifests(w io.Writer, manifests []map[string]interface{}) error {
+	for _, manifest := range manifests {
+		out, err := yaml.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(w, "---\n"); err != nil {
+			return err
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -31,6 +31,7 @@ import (
 	"log"
 	"net/http"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -38,13 +39,17 @@ import (
 )
 
 // createNamespace creates a new namespace
-func createNamespace(name string) error {
+func createNamespace(client *kubernetes.Clientset, name string, annotations map[string]string) error {
 	// mark the namespace as being deployed by emmie
 	m := make(map[string]string)
 	m["deployedBy"] = "emmie"
 
 	ns := &v1.Namespace{
-		ObjectMeta: v1.ObjectMeta{Name: name, Labels: m},
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Labels:      m,
+			Annotations: annotations,
+		},
 	}
 
 	_, err := client.Core().Namespaces().Create(ns)
@@ -58,7 +63,7 @@ func createNamespace(name string) error {
 }
 
 // listNamespaces by label
-func listNamespaces(labelKey, labelValue string) (*v1.NamespaceList, error) {
+func listNamespaces(client *kubernetes.Clientset, labelKey, labelValue string) (*v1.NamespaceList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Namespaces().List(listOptions)
@@ -75,8 +80,31 @@ func listNamespaces(labelKey, labelValue string) (*v1.NamespaceList, error) {
 	return list, nil
 }
 
+// getNamespace gets a namespace by name
+func getNamespace(client *kubernetes.Clientset, name string) (*v1.Namespace, error) {
+	ns, err := client.Core().Namespaces().Get(name)
+
+	if err != nil {
+		log.Println("[getNamespace] Error getting namespace", err)
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+// updateNamespace updates an existing namespace
+func updateNamespace(client *kubernetes.Clientset, ns *v1.Namespace) error {
+	_, err := client.Core().Namespaces().Update(ns)
+
+	if err != nil {
+		log.Println("[updateNamespace] Error updating namespace", err)
+	}
+
+	return err
+}
+
 // deleteNamespace delete a namespace
-func deleteNamespace(name string) {
+func deleteNamespace(client *kubernetes.Clientset, name string) {
 	// TODO: Use nil as DeleteOptions?
 	err := client.Namespaces().Delete(name, nil)
 
@@ -89,7 +117,7 @@ func deleteNamespace(name string) {
 }
 
 func getNamespacesRoute(w http.ResponseWriter, r *http.Request) {
-	nss, err := listNamespaces("deployedBy", "emmie")
+	nss, err := listNamespaces(defaultCluster.client, "deployedBy", "emmie")
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -0,0 +1,431 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// how long fetched signing keys are used before they are fetched again, and
+// how often an unknown key id may trigger an early fetch
+const (
+	jwksRefresh     = time.Hour
+	jwksMinInterval = time.Minute
+)
+
+// oidcVerifier checks JWTs issued by an OIDC provider and maps their groups
+// to the permissions of the groups file
+type oidcVerifier struct {
+	sync.Mutex
+	issuer   string
+	audience string
+	jwksURL  string
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	attempt  time.Time
+	groups   []apiToken
+}
+
+// groupsFile maps OIDC groups to permissions, each group is named like a token
+type groupsFile struct {
+	Groups []apiToken `json:"groups"`
+}
+
+// jwk is a single key of a JSON web key set
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtHeader is the part of a JWT header needed to pick the signing key
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifier of OIDC tokens, nil unless oidc-issuer is set
+var oidc *oidcVerifier
+
+// newOIDCVerifier reads the groups file, the signing keys are fetched on first use
+func newOIDCVerifier(issuer, audience, jwksURL, groupsPath string) (*oidcVerifier, error) {
+	v := &oidcVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		jwksURL:  jwksURL,
+		keys:     map[string]crypto.PublicKey{},
+	}
+
+	if groupsPath != "" {
+		data, err := ioutil.ReadFile(groupsPath)
+		if err != nil {
+			return nil, err
+		}
+
+		file := groupsFile{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		for _, group := range file.Groups {
+			if err := validatePermissions(group); err != nil {
+				return nil, fmt.Errorf("group %v", err)
+			}
+		}
+		v.groups = file.Groups
+	}
+
+	return v, nil
+}
+
+// looksLikeJWT checks for the three dot separated parts of a JWT
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// authenticate verifies a JWT and returns the user it identifies along with
+// the permissions of their groups
+func (v *oidcVerifier) authenticate(token string) (*identity, error) {
+	claims, err := v.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user := claimString(claims, *argOIDCUserClaim)
+	if user == "" {
+		user = claimString(claims, "sub")
+	}
+	if user == "" {
+		return nil, fmt.Errorf("token has no %s or sub claim", *argOIDCUserClaim)
+	}
+
+	caller := &identity{Name: user}
+	groups := claimStrings(claims, *argOIDCGroupsClaim)
+	for i := range v.groups {
+		if contains(groups, v.groups[i].Name) {
+			caller.grants = append(caller.grants, &v.groups[i])
+		}
+	}
+
+	return caller, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of a JWT
+func (v *oidcVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	header := jwtHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt signature: %v", err)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %v", err)
+	}
+
+	if iss := claimString(claims, "iss"); strings.TrimSuffix(iss, "/") != v.issuer {
+		return nil, fmt.Errorf("jwt issued by %q", iss)
+	}
+	if !contains(claimStrings(claims, "aud"), v.audience) {
+		return nil, fmt.Errorf("jwt not issued for %s", v.audience)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("jwt has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("jwt expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("jwt not valid yet")
+	}
+
+	return claims, nil
+}
+
+// key finds a signing key by id, fetching the key set when it is stale or
+// doesn't have the key
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	stale := time.Since(v.fetched) > jwksRefresh
+	if _, ok := v.lookupKey(kid); (stale || !ok) && time.Since(v.attempt) > jwksMinInterval {
+		v.attempt = time.Now()
+		if err := v.fetchKeys(); err != nil {
+			log.Println("[oidcVerifier] Error fetching signing keys:", err)
+		}
+	}
+
+	key, ok := v.lookupKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a cached key, a token without a key id matches a single key
+func (v *oidcVerifier) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// fetchKeys downloads the issuer's key set, discovering its url if it isn't configured
+func (v *oidcVerifier) fetchKeys() error {
+	jwksURL := v.jwksURL
+	if jwksURL == "" {
+		discovery := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return err
+		}
+		if discovery.JWKSURI == "" {
+			return fmt.Errorf("issuer %s has no jwks_uri", v.issuer)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := getJSON(jwksURL, &set); err != nil {
+		return err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("[fetchKeys] Skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.keys = keys
+	v.fetched = time.Now()
+	log.Printf("[fetchKeys] Loaded %d signing keys from %s", len(keys), jwksURL)
+	return nil
+}
+
+// publicKey decodes an RSA or EC key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks a JWS signature for the RS and ES algorithms
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signing key doesn't match %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signing key doesn't match %s", alg)
+		}
+		half := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*half {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		r := new(big.Int).SetBytes(signature[:half])
+		s := new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported jwt algorithm %q", alg)
+}
+
+// decodeSegment decodes a base64url encoded json part of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeBigInt decodes a base64url encoded big endian integer
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// claimString reads a string claim
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// claimStrings reads a claim which may be a single string or a list of them
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// getJSON fetches and decodes a json document
+func getJSON(url string, v interface{}) error {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIssuer serves OIDC discovery and a key set for test signing keys
+type stubIssuer struct {
+	sync.Mutex
+	server  *httptest.Server
+	keys    []jwk
+	fetches int
+}
+
+func newStubIssuer() *stubIssuer {
+	issuer := &stubIssuer{}
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.Lock()
+		defer issuer.Unlock()
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/keys"})
+		case "/keys":
+			issuer.fetches++
+			json.NewEncoder(w).Encode(map[string][]jwk{"keys": issuer.keys})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return issuer
+}
+
+// publish adds a public key to the issuer's key set
+func (s *stubIssuer) publish(kid string, key crypto.PublicKey) {
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+
+	k := jwk{Kid: kid, Use: "sig"}
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		k.Kty, k.N, k.E = "RSA", encode(pub.N), encode(big.NewInt(int64(pub.E)))
+	case *ecdsa.PublicKey:
+		k.Kty, k.Crv, k.X, k.Y = "EC", pub.Curve.Params().Name, encode(pub.X), encode(pub.Y)
+	}
+
+	s.Lock()
+	s.keys = append(s.keys, k)
+	s.Unlock()
+}
+
+// signJWT creates a JWT with the given header algorithm, key id and claims
+func signJWT(t *testing.T, alg, kid string, key crypto.PrivateKey, claims map[string]interface{}) string {
+	signed := segmentJSON(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segmentJSON(t, claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := newStubIssuer()
+	defer issuer.server.Close()
+	issuer.publish("rsa", &rsaKey.PublicKey)
+	issuer.publish("ec", &ecKey.PublicKey)
+
+	verifier, err := newOIDCVerifier(issuer.server.URL, "emmie", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer.server.URL,
+			"aud":   "emmie",
+			"sub":   "1234",
+			"email": "alice@example.com",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	valid := signJWT(t, "RS256", "rsa", rsaKey, claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "valid RS256", token: valid, ok: true},
+		{name: "valid ES256", token: signJWT(t, "ES256", "ec", ecKey, claims(nil)), ok: true},
+		{name: "audience list", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "emmie"}})), ok: true},
+		{name: "expired", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}))},
+		{name: "no expiry", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil}))},
+		{name: "not valid yet", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}))},
+		{name: "wrong issuer", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "wrong audience", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other-client"}))},
+		{name: "no audience", token: signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": nil}))},
+		{name: "unknown kid", token: signJWT(t, "RS256", "unknown", otherKey, claims(nil))},
+		{name: "signed by another key", token: signJWT(t, "RS256", "rsa", otherKey, claims(nil))},
+		{name: "alg none", token: segmentJSON(t, map[string]string{"alg": "none", "kid": "rsa"}) + "." + parts[1] + "."},
+		{name: "RS alg with EC key", token: signJWT(t, "RS256", "ec", rsaKey, claims(nil))},
+		{name: "ES alg with RSA key", token: signJWT(t, "ES256", "rsa", ecKey, claims(nil))},
+		{name: "HS256 with the public key", token: segmentJSON(t, map[string]string{"alg": "HS256", "kid": "rsa"}) + "." + parts[1] + "." + parts[2]},
+		{name: "lower case alg", token: segmentJSON(t, map[string]string{"alg": "rs256", "kid": "rsa"}) + "." + parts[1] + "." + parts[2]},
+		{name: "tampered claims", token: parts[0] + "." + segmentJSON(t, claims(map[string]interface{}{"email": "admin@example.com"})) + "." + parts[2]},
+		{name: "malformed", token: "a.b"},
+	}
+
+	for _, test := range tests {
+		_, err := verifier.verify(test.token)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verify error = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+
+	if issuer.fetches != 1 {
+		t.Errorf("fetched the key set %d times, want unknown key ids to wait for jwksMinInterval", issuer.fetches)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := newStubIssuer()
+	defer issuer.server.Close()
+	issuer.publish("old", &oldKey.PublicKey)
+
+	verifier, err := newOIDCVerifier(issuer.server.URL, "emmie", issuer.server.URL+"/keys", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"iss": issuer.server.URL, "aud": "emmie", "sub": "1234", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := verifier.verify(signJWT(t, "ES256", "old", oldKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.publish("new", &newKey.PublicKey)
+	rotated := signJWT(t, "ES256", "new", newKey, claims)
+	if _, err := verifier.verify(rotated); err == nil {
+		t.Error("a new key was fetched again within jwksMinInterval")
+	}
+
+	verifier.attempt = time.Now().Add(-2 * jwksMinInterval)
+	if _, err := verifier.verify(rotated); err != nil {
+		t.Errorf("a token signed with a rotated key was refused: %v", err)
+	}
+	if issuer.fetches != 2 {
+		t.Errorf("fetched the key set %d times, want 2", issuer.fetches)
+	}
+}
+
+func TestOIDCAuthenticateGroups(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := newStubIssuer()
+	defer issuer.server.Close()
+	issuer.publish("key", &key.PublicKey)
+
+	verifier, err := newOIDCVerifier(issuer.server.URL, "emmie", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.groups = []apiToken{
+		{Name: "payments-devs", Actions: []string{actionDeploy}, ImageNamespaces: []string{"payments"}},
+		{Name: "admins", Actions: knownActions},
+	}
+
+	token := signJWT(t, "ES256", "key", key, map[string]interface{}{
+		"iss":    issuer.server.URL,
+		"aud":    "emmie",
+		"sub":    "1234",
+		"email":  "alice@example.com",
+		"groups": []string{"payments-devs", "other"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+
+	caller, err := verifier.authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Name != "alice@example.com" {
+		t.Errorf("caller = %s, want the email claim", caller.Name)
+	}
+	if len(caller.grants) != 1 || caller.grants[0].Name != "payments-devs" {
+		t.Errorf("grants = %+v, want payments-devs only", caller.grants)
+	}
+}
+
+// segmentJSON encodes a value as a base64url JWT segment
+func segmentJSON(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,341 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annotation on a branch namespace holding the overrides it was deployed with
+const overridesAnnotation = "emmie-overrides"
+
+// largest deploy request body emmie will read
+const maxOverridesSize = 1 << 20
+
+// most replicas an override may ask for
+const maxOverrideReplicas = 100
+
+// deployOverrides are applied on top of the template copy, they can be sent
+// as json or yaml in the body of a deploy request
+type deployOverrides struct {
+	// Workloads are keyed by replication controller or deployment name
+	Workloads map[string]workloadOverride `json:"workloads,omitempty"`
+
+	// ConfigMaps are keyed by configmap name, each value is merged into its data
+	ConfigMaps map[string]scalarMap `json:"configMaps,omitempty"`
+}
+
+// workloadOverride changes a single replication controller or deployment
+type workloadOverride struct {
+	Replicas   *int32                       `json:"replicas,omitempty"`
+	Containers map[string]containerOverride `json:"containers,omitempty"`
+}
+
+// containerOverride changes a single container in a workload
+type containerOverride struct {
+	Image     string                   `json:"image,omitempty"`
+	Env       scalarMap                `json:"env,omitempty"`
+	Resources *v1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// scalarMap is a map of strings which also takes numbers and booleans, so
+// `DEBUG: true` in yaml overrides is the string "true"
+type scalarMap map[string]string
+
+// UnmarshalJSON keeps numbers and booleans as they were written
+func (m *scalarMap) UnmarshalJSON(data []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	values := scalarMap{}
+	for key, value := range raw {
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			values[key] = s
+			continue
+		}
+
+		text := strings.TrimSpace(string(value))
+		if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+			return fmt.Errorf("value of %s is not a string", key)
+		}
+		values[key] = text
+	}
+
+	*m = values
+	return nil
+}
+
+// content types a deploy request body is read as overrides for, other bodies
+// (e.g. a form carrying the token) are left alone
+var overridesContentTypes = map[string]bool{
+	"application/json":   true,
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+	"text/x-yaml":        true,
+}
+
+// readOverrides parses the overrides sent with a deploy request, nil is
+// returned when the request has no json or yaml body
+func readOverrides(w http.ResponseWriter, r *http.Request) (*deployOverrides, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !overridesContentTypes[mediaType] {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOverridesSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseOverrides(body)
+}
+
+// parseOverrides decodes overrides from json or yaml. The yaml is converted to
+// json first and decoded without yaml.Unmarshal, which panics setting the
+// pointer fields of a workload or container held in a map
+func parseOverrides(data []byte) (*deployOverrides, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, nil
+	}
+
+	converted, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid overrides: %v", err)
+	}
+
+	overrides := &deployOverrides{}
+	if err := json.Unmarshal(converted, overrides); err != nil {
+		return nil, fmt.Errorf("invalid overrides: %v", err)
+	}
+
+	for name, workload := range overrides.Workloads {
+		if workload.Replicas != nil && (*workload.Replicas < 0 || *workload.Replicas > maxOverrideReplicas) {
+			return nil, fmt.Errorf("invalid overrides: replicas of %s must be between 0 and %d", name, maxOverrideReplicas)
+		}
+	}
+
+	return overrides, nil
+}
+
+// overridesFor returns the overrides a branch namespace was last deployed with
+func overridesFor(ns *v1.Namespace) *deployOverrides {
+	value, ok := ns.Annotations[overridesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	overrides, err := parseOverrides([]byte(value))
+	if err != nil {
+		return nil
+	}
+
+	return overrides
+}
+
+// setOverridesAnnotation records overrides in a set of annotations
+func setOverridesAnnotation(annotations map[string]string, overrides *deployOverrides) map[string]string {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	if overrides == nil {
+		delete(annotations, overridesAnnotation)
+		return annotations
+	}
+
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return annotations
+	}
+
+	annotations[overridesAnnotation] = string(data)
+	return annotations
+}
+
+// workload returns the override for a workload
+func (o *deployOverrides) workload(name string) (workloadOverride, bool) {
+	if o == nil {
+		return workloadOverride{}, false
+	}
+
+	override, ok := o.Workloads[name]
+	return override, ok
+}
+
+// configMap returns the data to merge into a configmap
+func (o *deployOverrides) configMap(name string) (map[string]string, bool) {
+	if o == nil {
+		return nil, false
+	}
+
+	data, ok := o.ConfigMaps[name]
+	return data, ok
+}
+
+// imageNamespaces lists the image namespaces of the images set by overrides,
+// each image has to be a {namespace}/{app} image in the cluster's registry
+func (o *deployOverrides) imageNamespaces(c *cluster) ([]string, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	namespaces := []string{}
+	for workloadName, workload := range o.Workloads {
+		for containerName, container := range workload.Containers {
+			if container.Image == "" {
+				continue
+			}
+
+			namespace, err := imageNamespaceOf(c, container.Image)
+			if err != nil {
+				return nil, fmt.Errorf("image override for %s/%s: %v", workloadName, containerName, err)
+			}
+			if !contains(namespaces, namespace) {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// imageNamespaceOf finds the image namespace of an image in the cluster's
+// registry (e.g. payments for registry.example.com/payments/web:feature)
+func imageNamespaceOf(c *cluster, image string) (string, error) {
+	if !strings.HasPrefix(image, c.DockerRegistry) {
+		return "", fmt.Errorf("%s isn't in registry %s", image, c.DockerRegistry)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(image, c.DockerRegistry), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("%s isn't a {namespace}/{app} image", image)
+	}
+
+	// without a registry the first part of a name like host:5000/app is a registry
+	if c.DockerRegistry == "" && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return "", fmt.Errorf("%s is in another registry", image)
+	}
+
+	return parts[0], nil
+}
+
+// unknownTargets lists overrides which don't match anything in the template
+func (o *deployOverrides) unknownTargets(workloads map[string][]string, configmaps map[string]bool) []string {
+	if o == nil {
+		return nil
+	}
+
+	errors := []string{}
+	for name, override := range o.Workloads {
+		containers, ok := workloads[name]
+		if !ok {
+			errors = append(errors, fmt.Sprintf("override for unknown workload %q", name))
+			continue
+		}
+
+		for containerName := range override.Containers {
+			if !contains(containers, containerName) {
+				errors = append(errors, fmt.Sprintf("override for unknown container %q in workload %q", containerName, name))
+			}
+		}
+	}
+
+	for name := range o.ConfigMaps {
+		if !configmaps[name] {
+			errors = append(errors, fmt.Sprintf("override for unknown configmap %q", name))
+		}
+	}
+
+	return errors
+}
+
+// mergeData returns a copy of data with the overrides applied
+func mergeData(data, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(data)+len(overrides))
+	for key, value := range data {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// applyContainerOverride changes a container's env and resources
+func applyContainerOverride(container *v1.Container, override containerOverride) {
+	names := []string{}
+	for name := range override.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := override.Env[name]
+		found := false
+		for i, env := range container.Env {
+			if env.Name == name {
+				container.Env[i] = v1.EnvVar{Name: name, Value: value}
+				found = true
+			}
+		}
+
+		if !found {
+			container.Env = append(container.Env, v1.EnvVar{Name: name, Value: value})
+		}
+	}
+
+	if override.Resources != nil {
+		container.Resources = *override.Resources
+	}
+}
+
+// contains checks if a string is in a list
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
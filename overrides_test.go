@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		nilValue bool
+		failed   bool
+		message  string
+		check    func(o *deployOverrides) bool
+	}{
+		{name: "empty", data: "", nilValue: true},
+		{name: "whitespace", data: "  \n\t", nilValue: true},
+		{name: "invalid", data: "workloads: [", failed: true},
+		{name: "negative replicas", data: "workloads:\n  web:\n    replicas: -1\n", failed: true, message: "replicas of web must be between 0 and 100"},
+		{name: "too many replicas", data: "workloads:\n  web:\n    replicas: 2000000000\n", failed: true, message: "replicas of web must be between 0 and 100"},
+		{name: "replicas over int32", data: `{"workloads": {"web": {"replicas": 5000000000}}}`, failed: true},
+		{name: "zero replicas", data: "workloads:\n  web:\n    replicas: 0\n", check: func(o *deployOverrides) bool {
+			return *o.Workloads["web"].Replicas == 0
+		}},
+		{
+			name: "yaml",
+			data: "workloads:\n  web:\n    replicas: 2\n    containers:\n      web:\n        env:\n          LOG_LEVEL: debug\n",
+			check: func(o *deployOverrides) bool {
+				web := o.Workloads["web"]
+				return web.Replicas != nil && *web.Replicas == 2 && web.Containers["web"].Env["LOG_LEVEL"] == "debug"
+			},
+		},
+		{
+			name: "resources",
+			data: "workloads:\n  web:\n    containers:\n      web:\n        image: registry/payments/web:pr-1\n        resources:\n          requests:\n            cpu: 250m\n            memory: 1Gi\n          limits:\n            cpu: 1\n",
+			check: func(o *deployOverrides) bool {
+				web := o.Workloads["web"].Containers["web"]
+				return web.Image == "registry/payments/web:pr-1" && web.Resources != nil &&
+					quantity(web.Resources.Requests, v1.ResourceCPU).MilliValue() == 250 &&
+					quantity(web.Resources.Requests, v1.ResourceMemory).Value() == 1<<30 &&
+					quantity(web.Resources.Limits, v1.ResourceCPU).MilliValue() == 1000
+			},
+		},
+		{
+			name: "json replicas and resources",
+			data: `{"workloads": {"web": {"replicas": 3, "containers": {"web": {"resources": {"limits": {"memory": "512Mi"}}}}}}}`,
+			check: func(o *deployOverrides) bool {
+				web := o.Workloads["web"]
+				return *web.Replicas == 3 && quantity(web.Containers["web"].Resources.Limits, v1.ResourceMemory).Value() == 512<<20
+			},
+		},
+		{
+			name: "scalar values",
+			data: "workloads:\n  web:\n    containers:\n      web:\n        env:\n          DEBUG: true\n          WORKERS: 4\nconfigMaps:\n  web-config:\n    ratio: 0.5\n",
+			check: func(o *deployOverrides) bool {
+				env := o.Workloads["web"].Containers["web"].Env
+				return env["DEBUG"] == "true" && env["WORKERS"] == "4" && o.ConfigMaps["web-config"]["ratio"] == "0.5"
+			},
+		},
+		{name: "nested env value", data: "workloads:\n  web:\n    containers:\n      web:\n        env:\n          A: {b: c}\n", failed: true},
+		{name: "invalid quantity", data: "workloads:\n  web:\n    containers:\n      web:\n        resources:\n          limits:\n            cpu: lots\n", failed: true},
+		{
+			name: "json",
+			data: `{"configMaps": {"web-config": {"feature.flag": "true"}}}`,
+			check: func(o *deployOverrides) bool {
+				return o.ConfigMaps["web-config"]["feature.flag"] == "true"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		overrides, err := parseOverrides([]byte(test.data))
+		if (err != nil) != test.failed {
+			t.Errorf("%s: parseOverrides error = %v, want failure %v", test.name, err, test.failed)
+			continue
+		}
+		if test.failed {
+			if test.message != "" && !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s: parseOverrides error = %v, want %q", test.name, err, test.message)
+			}
+			continue
+		}
+		if (overrides == nil) != test.nilValue {
+			t.Errorf("%s: parseOverrides = %v, want nil %v", test.name, overrides, test.nilValue)
+			continue
+		}
+		if test.check != nil && !test.check(overrides) {
+			t.Errorf("%s: parseOverrides = %+v", test.name, overrides)
+		}
+	}
+}
+
+func TestReadOverridesContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		read        bool
+	}{
+		{contentType: "application/json", body: `{"configMaps": {"a": {"b": "c"}}}`, read: true},
+		{contentType: "application/x-yaml; charset=UTF-8", body: "configMaps:\n  a:\n    b: c\n", read: true},
+		{contentType: "text/yaml", body: "configMaps:\n  a:\n    b: c\n", read: true},
+		{contentType: "application/x-www-form-urlencoded", body: "token=secret", read: false},
+		{contentType: "", body: "configMaps:\n  a:\n    b: c\n", read: false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/deploy/payments/feature-x", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+
+		overrides, err := readOverrides(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("%q: readOverrides error = %v", test.contentType, err)
+			continue
+		}
+		if (overrides != nil) != test.read {
+			t.Errorf("%q: readOverrides = %v, want read %v", test.contentType, overrides, test.read)
+		}
+	}
+
+	// a form body is still there for the token lookup
+	r := httptest.NewRequest("POST", "/deploy/payments/feature-x", strings.NewReader("token=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	readOverrides(httptest.NewRecorder(), r)
+	if got := r.FormValue("token"); got != "secret" {
+		t.Errorf("form token after readOverrides = %q, want secret", got)
+	}
+}
+
+func TestImageNamespaceOf(t *testing.T) {
+	tests := []struct {
+		registry string
+		image    string
+		want     string
+	}{
+		{registry: "registry.example.com/", image: "registry.example.com/payments/web:feature-x", want: "payments"},
+		{registry: "registry.example.com/", image: "registry.example.com/payments/web@sha256:abc", want: "payments"},
+		{registry: "registry.example.com/", image: "evil.example.com/payments/web:latest"},
+		{registry: "registry.example.com/", image: "registry.example.com/web:latest"},
+		{registry: "registry.example.com/", image: "registry.example.com/payments/web/extra:latest"},
+		{registry: "", image: "payments/web:experiment", want: "payments"},
+		{registry: "", image: "evil.example.com/web:latest"},
+		{registry: "", image: "localhost/web:latest"},
+		{registry: "", image: "web:latest"},
+	}
+
+	for _, test := range tests {
+		got, err := imageNamespaceOf(&cluster{DockerRegistry: test.registry}, test.image)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("imageNamespaceOf(%q, %q) = %q, want an error", test.registry, test.image, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("imageNamespaceOf(%q, %q) = %q, %v, want %q", test.registry, test.image, got, err, test.want)
+		}
+	}
+}
+
+func TestOverrideImageNamespaces(t *testing.T) {
+	c := &cluster{DockerRegistry: "registry.example.com/"}
+
+	var none *deployOverrides
+	if namespaces, err := none.imageNamespaces(c); err != nil || len(namespaces) != 0 {
+		t.Errorf("nil overrides imageNamespaces = %v, %v", namespaces, err)
+	}
+
+	overrides, err := parseOverrides([]byte(`
+workloads:
+  web:
+    containers:
+      web:
+        image: registry.example.com/payments/web:experiment
+      sidecar:
+        env:
+          A: b
+  api:
+    containers:
+      api:
+        image: registry.example.com/billing/api:experiment
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err := overrides.imageNamespaces(c)
+	if err != nil || len(namespaces) != 2 || namespaces[0] != "billing" || namespaces[1] != "payments" {
+		t.Errorf("imageNamespaces = %v, %v, want billing and payments", namespaces, err)
+	}
+
+	overrides.Workloads["api"].Containers["api"] = containerOverride{Image: "docker.io/library/busybox"}
+	if _, err := overrides.imageNamespaces(c); err == nil {
+		t.Error("an image from another registry was accepted")
+	}
+}
+
+// quantity reads a resource from a list, zero when it isn't set
+func quantity(list v1.ResourceList, name v1.ResourceName) *resource.Quantity {
+	q := list[name]
+	return &q
+}
@@ -0,0 +1,736 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// deployPlan holds every object Emmie would create for a branch along with
+// the image decisions made while rendering them
+type deployPlan struct {
+	Cluster                string                      `json:"cluster"`
+	Namespace              string                      `json:"namespace"`
+	ImageNamespace         string                      `json:"imageNamespace"`
+	TemplateNamespace      string                      `json:"templateNamespace"`
+	Selector               string                      `json:"selector,omitempty"`
+	BaselineNamespace      string                      `json:"baselineNamespace,omitempty"`
+	Overlay                bool                        `json:"overlay,omitempty"`
+	Overrides              *deployOverrides            `json:"overrides,omitempty"`
+	User                   string                      `json:"user,omitempty"`
+	Excluded               []string                    `json:"excluded,omitempty"`
+	Errors                 []string                    `json:"errors,omitempty"`
+	Images                 []imageResolution           `json:"images"`
+	ConfigMaps             []*v1.ConfigMap             `json:"configMaps"`
+	Secrets                []*v1.Secret                `json:"secrets"`
+	Services               []*v1.Service               `json:"services"`
+	ReplicationControllers []*v1.ReplicationController `json:"replicationControllers"`
+	Deployments            []*v1beta1.Deployment       `json:"deployments"`
+	Ingresses              []*v1beta1.Ingress          `json:"ingresses"`
+	Hooks                  []*batchv1.Job              `json:"hooks,omitempty"`
+	Layers                 [][]string                  `json:"layers,omitempty"`
+	ResourceQuotas         []*v1.ResourceQuota         `json:"resourceQuotas,omitempty"`
+	LimitRanges            []*v1.LimitRange            `json:"limitRanges,omitempty"`
+
+	cluster *cluster
+
+	// namespaceCreated is set once a new environment's namespace was created
+	// while it was admitted
+	namespaceCreated bool
+}
+
+// imageResolution records which image a container was given and why
+type imageResolution struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	BranchTag bool   `json:"branchTag"`
+	Reason    string `json:"reason"`
+}
+
+// exclude records a template object which was not cloned into the branch
+func (p *deployPlan) exclude(kind, name string) {
+	p.Excluded = append(p.Excluded, fmt.Sprintf("%s/%s", kind, name))
+}
+
+// deployRequest describes what a caller asked emmie to deploy
+type deployRequest struct {
+	// Cluster is where the branch is deployed
+	Cluster *cluster
+
+	ImageNamespace    string
+	BranchName        string
+	TemplateNamespace string
+
+	// Selector limits which template workloads, services and ingresses are cloned
+	Selector labels.Selector
+
+	// BaselineNamespace receives traffic for services not cloned into the branch
+	BaselineNamespace string
+
+	// Overlay only clones workloads whose image has a tag for the branch
+	Overlay bool
+
+	// Overrides are applied on top of the template copy
+	Overrides *deployOverrides
+
+	// User is the caller the environment is deployed for
+	User string
+}
+
+// buildDeployPlan renders the template namespace into the objects for a branch
+func buildDeployPlan(req deployRequest) (*deployPlan, error) {
+	imageNamespace := req.ImageNamespace
+	branchName := req.BranchName
+	templateNamespace := req.TemplateNamespace
+	baselineNamespace := req.BaselineNamespace
+	client := req.Cluster.client
+
+	selector := req.Selector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+
+	plan := &deployPlan{
+		Cluster:           req.Cluster.Name,
+		Namespace:         branchName,
+		ImageNamespace:    imageNamespace,
+		TemplateNamespace: templateNamespace,
+		Selector:          selector.String(),
+		BaselineNamespace: baselineNamespace,
+		Overlay:           req.Overlay,
+		Overrides:         req.Overrides,
+		User:              req.User,
+		cluster:           req.Cluster,
+	}
+
+	// copy controllers / services based on label query
+	rcs, err := listReplicationControllersByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(rcs.Items), " template replication controllers to copy.")
+
+	deployments, err := listDeploymentsByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(deployments.Items), " template deployments to copy.")
+
+	svcs, err := listServicesByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(svcs.Items), " template services to copy.")
+
+	secrets, err := listSecretsByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(secrets.Items), " template secrets to copy.")
+
+	configmaps, err := listConfigMapsByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(configmaps.Items), " template configmaps to copy.")
+
+	ingresses, err := listIngresssByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Found ", len(ingresses.Items), " template ingresses to copy.")
+
+	jobs, err := listJobsByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// work out ingress hosts first so they can be used as placeholders
+	sub := newSubstituter(req.Cluster, branchName, imageNamespace, templateNamespace)
+	hosts := map[string]string{}
+	for _, ingress := range ingresses.Items {
+		hosts[ingress.Name] = ingressHost(sub, ingress, branchName, req.Cluster.SubDomain)
+	}
+	if len(ingresses.Items) > 0 {
+		sub.setHosts(hosts, ingresses.Items[0].Name)
+	}
+
+	// configmaps
+	for _, configmap := range configmaps.Items {
+
+		data := configmap.Data
+		if overrideData, ok := req.Overrides.configMap(configmap.Name); ok {
+			data = mergeData(data, overrideData)
+		}
+		if sub.enabled(configmap.Annotations) {
+			data = sub.expandMap("ConfigMap/"+configmap.Name, data)
+		}
+
+		requestConfigMap := &v1.ConfigMap{
+			TypeMeta: unversioned.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      configmap.Name,
+				Namespace: branchName,
+			},
+			Data: data,
+		}
+
+		plan.ConfigMaps = append(plan.ConfigMaps, requestConfigMap)
+	}
+
+	// secrets
+	for _, secret := range secrets.Items {
+
+		// skip service accounts
+		if secret.Type != "kubernetes.io/service-account-token" {
+
+			data, err := branchSecretData(client, secret, branchName)
+			if err != nil {
+				log.Println("[buildDeployPlan] Error generating secret values", err)
+				return nil, err
+			}
+
+			// values kept in vault are read at deploy time rather than copied
+			if path := secret.Annotations[vaultAnnotation]; path != "" {
+				values, err := readVaultSecret(path)
+				if err != nil {
+					log.Println("[buildDeployPlan] Error reading secret from vault", err)
+					plan.Errors = append(plan.Errors, fmt.Sprintf("Secret/%s: %v", secret.Name, err))
+				} else {
+					data = mergeSecretData(data, values)
+				}
+			}
+
+			requestSecret := &v1.Secret{
+				TypeMeta: unversioned.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+				ObjectMeta: v1.ObjectMeta{
+					Name:      secret.Name,
+					Namespace: branchName,
+				},
+				Type: secret.Type,
+				Data: data,
+			}
+
+			plan.Secrets = append(plan.Secrets, requestSecret)
+		}
+	}
+
+	// pod labels of the workloads cloned into the branch and the services
+	// which were cloned to serve them
+	podLabels := []map[string]string{}
+	branchServices := map[string]bool{}
+
+	// containers of every template workload, used to check overrides
+	workloadContainers := map[string][]string{}
+
+	// now that we have all replicationControllers, update them to have new image name
+	for _, rc := range rcs.Items {
+
+		if !selector.Matches(labels.Set(rc.Labels)) {
+			plan.exclude("ReplicationController", rc.Name)
+			continue
+		}
+
+		override, _ := req.Overrides.workload(rc.Name)
+		workloadContainers[rc.Name] = containerNames(rc.Spec.Template.Spec.Containers)
+		branchImage := plan.updateContainers(req, "ReplicationController", rc.Name, rc.Annotations["emmie-update"], rc.Spec.Template.Spec.Containers, override)
+
+		// overlays only run workloads which were built for the branch
+		if req.Overlay && !branchImage {
+			plan.exclude("ReplicationController", rc.Name)
+			continue
+		}
+		podLabels = append(podLabels, rc.Spec.Template.Labels)
+
+		requestController := &v1.ReplicationController{
+			TypeMeta: unversioned.TypeMeta{Kind: "ReplicationController", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      rc.ObjectMeta.Name,
+				Namespace: branchName,
+			},
+		}
+
+		requestController.Spec = rc.Spec
+		requestController.Annotations = rc.Annotations
+
+		if sub.enabled(rc.Annotations) {
+			sub.expandContainers("ReplicationController/"+rc.Name, requestController.Spec.Template.Spec.Containers)
+			requestController.Annotations = sub.expandMap("ReplicationController/"+rc.Name+" annotation", rc.Annotations)
+		}
+		requestController.Spec.Replicas = defaultReplicaCount
+		if override.Replicas != nil {
+			requestController.Spec.Replicas = override.Replicas
+		}
+
+		plan.ReplicationControllers = append(plan.ReplicationControllers, requestController)
+	}
+
+	// now that we have all deployments, update them to have new image name
+	for _, dply := range deployments.Items {
+
+		if !selector.Matches(labels.Set(dply.Labels)) {
+			plan.exclude("Deployment", dply.Name)
+			continue
+		}
+
+		override, _ := req.Overrides.workload(dply.Name)
+		workloadContainers[dply.Name] = containerNames(dply.Spec.Template.Spec.Containers)
+		branchImage := plan.updateContainers(req, "Deployment", dply.Name, dply.Annotations["emmie-update"], dply.Spec.Template.Spec.Containers, override)
+
+		// overlays only run workloads which were built for the branch
+		if req.Overlay && !branchImage {
+			plan.exclude("Deployment", dply.Name)
+			continue
+		}
+		podLabels = append(podLabels, dply.Spec.Template.Labels)
+
+		deployment := &v1beta1.Deployment{
+			TypeMeta: unversioned.TypeMeta{Kind: "Deployment", APIVersion: "extensions/v1beta1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      dply.ObjectMeta.Name,
+				Namespace: branchName,
+			},
+		}
+
+		deployment.Spec = dply.Spec
+		deployment.Annotations = dply.Annotations
+
+		if sub.enabled(dply.Annotations) {
+			sub.expandContainers("Deployment/"+dply.Name, deployment.Spec.Template.Spec.Containers)
+			deployment.Annotations = sub.expandMap("Deployment/"+dply.Name+" annotation", dply.Annotations)
+		}
+		deployment.Spec.Replicas = defaultReplicaCount
+		if override.Replicas != nil {
+			deployment.Spec.Replicas = override.Replicas
+		}
+
+		plan.Deployments = append(plan.Deployments, deployment)
+	}
+
+	// services
+	for _, svc := range svcs.Items {
+
+		// services left out of the branch can still resolve to the baseline
+		if !selector.Matches(labels.Set(svc.Labels)) || (req.Overlay && !servesWorkload(svc, podLabels)) {
+			plan.exclude("Service", svc.Name)
+			if baselineNamespace != "" {
+				plan.Services = append(plan.Services, externalNameService(svc, branchName, baselineNamespace))
+			}
+			continue
+		}
+
+		requestService := &v1.Service{
+			TypeMeta: unversioned.TypeMeta{Kind: "Service", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      svc.ObjectMeta.Name,
+				Namespace: branchName,
+			},
+		}
+
+		ports := []v1.ServicePort{}
+		for _, port := range svc.Spec.Ports {
+			newPort := v1.ServicePort{
+				Name:       port.Name,
+				Protocol:   port.Protocol,
+				Port:       port.Port,
+				TargetPort: port.TargetPort,
+			}
+
+			ports = append(ports, newPort)
+		}
+
+		requestService.Spec.Ports = ports
+		requestService.Spec.Selector = svc.Spec.Selector
+		requestService.Spec.Type = svc.Spec.Type
+		requestService.Labels = svc.Labels
+
+		plan.Services = append(plan.Services, requestService)
+		branchServices[svc.Name] = true
+	}
+
+	// ingress
+	for _, ingress := range ingresses.Items {
+
+		if !selector.Matches(labels.Set(ingress.Labels)) || (req.Overlay && !routesToAny(ingress, branchServices)) {
+			plan.exclude("Ingress", ingress.Name)
+			continue
+		}
+
+		rules := ingress.Spec.Rules
+		if len(rules) > 0 {
+			rules[0].Host = hosts[ingress.Name]
+		}
+
+		annotations := ingress.Annotations
+		if sub.enabled(ingress.Annotations) {
+			annotations = sub.expandMap("Ingress/"+ingress.Name+" annotation", annotations)
+		}
+
+		requestIngress := &v1beta1.Ingress{
+			TypeMeta: unversioned.TypeMeta{Kind: "Ingress", APIVersion: "extensions/v1beta1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:        ingress.Name,
+				Namespace:   branchName,
+				Annotations: annotations,
+			},
+			Spec: v1beta1.IngressSpec{
+				Rules: rules,
+			},
+		}
+
+		plan.Ingresses = append(plan.Ingresses, requestIngress)
+	}
+
+	// hooks
+	for _, job := range jobs.Items {
+
+		phase := job.Annotations[hookAnnotation]
+		if phase != hookPreDeploy && phase != hookPostDeploy {
+			continue
+		}
+
+		plan.Hooks = append(plan.Hooks, plan.renderHook(req, sub, job))
+	}
+
+	// order workloads by their dependencies
+	deps := map[string][]string{}
+	for _, rc := range plan.ReplicationControllers {
+		deps[rc.Name] = dependsOn(rc.Annotations)
+	}
+	for _, deployment := range plan.Deployments {
+		deps[deployment.Name] = dependsOn(deployment.Annotations)
+	}
+
+	plan.Layers, err = dependencyLayers(deps)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err.Error())
+	}
+
+	// quotas are checked against the workloads before anything is created
+	plan.ResourceQuotas, plan.LimitRanges, err = namespaceQuotas(client, templateNamespace, branchName)
+	if err != nil {
+		return nil, err
+	}
+	plan.Errors = append(plan.Errors, checkQuota(plan)...)
+
+	configmapNames := map[string]bool{}
+	for _, configmap := range configmaps.Items {
+		configmapNames[configmap.Name] = true
+	}
+
+	plan.Errors = append(plan.Errors, sub.errors...)
+	plan.Errors = append(plan.Errors, req.Overrides.unknownTargets(workloadContainers, configmapNames)...)
+
+	return plan, nil
+}
+
+// updateContainers points the container named by the emmie-update annotation
+// at the branch image and applies any container overrides, it reports whether
+// the workload ended up running an image built for the branch
+func (p *deployPlan) updateContainers(req deployRequest, kind, name, containerNameToUpdate string, containers []v1.Container, override workloadOverride) bool {
+	if containerNameToUpdate != "" {
+		log.Printf("Container to update with emmie is: %s", containerNameToUpdate)
+	}
+	branchImage := false
+
+	// Find the container which matches the annotation
+	for i, container := range containers {
+
+		imageName := container.Image
+		containerOverride, overridden := override.Containers[container.Name]
+
+		if overridden && containerOverride.Image != "" {
+			resolution := imageResolution{
+				Kind:      kind,
+				Name:      name,
+				Container: container.Name,
+				Image:     containerOverride.Image,
+				BranchTag: true,
+				Reason:    "image override from deploy request",
+			}
+			p.Images = append(p.Images, resolution)
+
+			imageName = resolution.Image
+			branchImage = true
+		} else if containerNameToUpdate == container.Name {
+			resolution := resolveImage(req.Cluster, req.ImageNamespace, req.BranchName, name, container.Image)
+			resolution.Kind = kind
+			resolution.Container = container.Name
+			p.Images = append(p.Images, resolution)
+
+			imageName = resolution.Image
+			branchImage = resolution.BranchTag
+		}
+
+		containers[i].Image = imageName
+
+		// Set the image pull policy to "Always"
+		containers[i].ImagePullPolicy = "Always"
+
+		if overridden {
+			applyContainerOverride(&containers[i], containerOverride)
+		}
+	}
+
+	return branchImage
+}
+
+// renderHook copies a template hook job for the branch with its image updated
+// and placeholders expanded
+func (p *deployPlan) renderHook(req deployRequest, sub *substituter, job batchv1.Job) *batchv1.Job {
+	hook := hookJob(job, req.BranchName)
+	p.updateContainers(req, "Job", job.Name, job.Annotations["emmie-update"], hook.Spec.Template.Spec.Containers, workloadOverride{})
+
+	if sub.enabled(job.Annotations) {
+		sub.expandContainers("Job/"+job.Name, hook.Spec.Template.Spec.Containers)
+	}
+
+	return hook
+}
+
+// containerNames lists the names of a set of containers
+func containerNames(containers []v1.Container) []string {
+	names := []string{}
+	for _, container := range containers {
+		names = append(names, container.Name)
+	}
+
+	return names
+}
+
+// ingressHost works out the external host of an ingress, a templated host on
+// the first rule is expanded otherwise the ingress name is prefixed to the
+// branch so multiple ingresses get unique hosts
+func ingressHost(sub *substituter, ingress v1beta1.Ingress, branchName, subDomain string) string {
+	if len(ingress.Spec.Rules) > 0 && sub.enabled(ingress.Annotations) && strings.Contains(ingress.Spec.Rules[0].Host, "{{") {
+		return sub.expand("Ingress/"+ingress.Name+" host", ingress.Spec.Rules[0].Host)
+	}
+
+	return fmt.Sprintf("%s-%s.%s", ingress.Name, branchName, subDomain)
+}
+
+// resolveImage decides which image a container updated by emmie should run
+func resolveImage(c *cluster, imageNamespace, branchName, appName, templateImage string) imageResolution {
+	resolution := imageResolution{
+		Name:      appName,
+		Image:     fmt.Sprintf("%s%s/%s:%s", c.DockerRegistry, imageNamespace, appName, branchName),
+		BranchTag: true,
+	}
+
+	if c.AWSRegistryID == "" {
+		resolution.Reason = "ECR lookup disabled, using branch tag"
+		return resolution
+	}
+
+	// Check if image exists in ECR
+	imageTag := fmt.Sprintf("%s/%s", imageNamespace, appName)
+	exists, err := imageTagExists(imageTag, branchName, c.AWSRegion, c.AWSRegistryID)
+
+	if err != nil {
+		log.Println("Error looking up image tag in ECR: ", err)
+		resolution.Image = templateImage
+		resolution.BranchTag = false
+		resolution.Reason = fmt.Sprintf("ECR lookup failed, using template image: %v", err)
+		return resolution
+	}
+
+	// if the image tag exists, then update to use, otherwise default
+	if !exists {
+		resolution.Image = templateImage
+		resolution.BranchTag = false
+		resolution.Reason = "branch tag not found in ECR, using template image"
+		return resolution
+	}
+
+	log.Printf("Image tag found in ECR, updating image [%s] with tag [%s]", appName, branchName)
+	resolution.Reason = "branch tag found in ECR"
+	return resolution
+}
+
+// applyDeployPlan creates the branch namespace, clears out anything left from
+// a previous deploy and then creates every object in the plan
+func applyDeployPlan(plan *deployPlan, status *deployStatus) error {
+	namespace := plan.Namespace
+	c := plan.cluster
+	client := c.client
+
+	// create namespace, unless it was created when the environment was admitted
+	var err error
+	if !plan.namespaceCreated {
+		err = createNamespace(client, namespace, plan.namespaceAnnotations(nil))
+	}
+
+	if err != nil {
+		// TODO: Don't use error for logic
+		// Existing namespace, do an update
+		log.Println("Existing namespace found: ", namespace, " deleting objects.")
+
+		// objects are removed using the template they were cloned from
+		previousTemplate := c.TemplateNamespace
+		if ns, err := getNamespace(client, namespace); err == nil {
+			previousTemplate = templateNamespaceFor(c, ns)
+
+			if previousTemplate != plan.TemplateNamespace {
+				log.Println("Switching template namespace from ", previousTemplate, " to ", plan.TemplateNamespace)
+			}
+
+			ns.Annotations = plan.namespaceAnnotations(ns.Annotations)
+			updateNamespace(client, ns)
+		}
+
+		deleteAllObjects(c, namespace, previousTemplate)
+		deletePodsByNamespace(client, namespace)
+
+		// Meh
+		time.Sleep(time.Second * 4)
+	} else {
+		log.Println("Namespace created, deploying new app...")
+	}
+
+	replaceNamespaceQuotas(plan)
+
+	for _, configmap := range plan.ConfigMaps {
+		createConfigMap(client, namespace, configmap)
+	}
+
+	for _, secret := range plan.Secrets {
+		createSecret(client, namespace, secret)
+	}
+
+	for _, svc := range plan.Services {
+		createService(client, namespace, svc)
+	}
+
+	if err := runHooks(client, namespace, hookPreDeploy, plan.Hooks, status); err != nil {
+		return err
+	}
+
+	// create workloads a layer at a time, waiting for each layer to be ready
+	// before starting the workloads which depend on it
+	for i, layer := range plan.Layers {
+		for _, rc := range plan.ReplicationControllers {
+			if inLayer(layer, rc.Name) {
+				createReplicationController(client, namespace, rc)
+			}
+		}
+
+		for _, deployment := range plan.Deployments {
+			if inLayer(layer, deployment.Name) {
+				createDeployment(client, namespace, deployment)
+			}
+		}
+
+		if i < len(plan.Layers)-1 {
+			log.Println("Waiting for workloads to be ready: ", layer)
+			if err := waitForWorkloads(plan, layer, *argReadyTimeout); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ingress := range plan.Ingresses {
+		createIngress(client, namespace, ingress)
+	}
+
+	// post-deploy hooks expect the environment to be up
+	if len(hooksForPhase(plan.Hooks, hookPostDeploy)) > 0 {
+		if err := waitForWorkloads(plan, nil, *argReadyTimeout); err != nil {
+			return err
+		}
+
+		if err := runHooks(client, namespace, hookPostDeploy, plan.Hooks, status); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// namespaceAnnotations records how the branch was deployed so later updates
+// and deletes can do the same
+func (p *deployPlan) namespaceAnnotations(annotations map[string]string) map[string]string {
+	annotations = setTemplateAnnotation(annotations, p.TemplateNamespace)
+	annotations[imageNamespaceAnnotation] = p.ImageNamespace
+	annotations[deployedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if p.User != "" {
+		annotations[deployedByAnnotation] = p.User
+	}
+	return setOverridesAnnotation(annotations, p.Overrides)
+}
+
+// formats a plan can be written in, json unless yaml is asked for
+const (
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// validOutputFormat checks a plan can be written in a format, empty is json
+func validOutputFormat(format string) bool {
+	return format == "" || format == outputJSON || format == outputYAML
+}
+
+// writeDeployPlan encodes the plan as json or yaml, with the values of its
+// secrets (copied, generated or read from vault) redacted
+func writeDeployPlan(w io.Writer, plan *deployPlan, format string) error {
+	if !validOutputFormat(format) {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+
+	shown := *plan
+	shown.Secrets = make([]*v1.Secret, len(plan.Secrets))
+	for i, secret := range plan.Secrets {
+		redacted := redactSecret(*secret)
+		shown.Secrets[i] = &redacted
+	}
+
+	if format == outputYAML {
+		out, err := yaml.Marshal(&shown)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(out)
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(&shown)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestWriteDeployPlanRedactsSecrets(t *testing.T) {
+	plan := &deployPlan{
+		Namespace: "feature-x",
+		Secrets: []*v1.Secret{{
+			ObjectMeta: v1.ObjectMeta{Name: "db", Namespace: "feature-x"},
+			Data:       map[string][]byte{"password": []byte("hunter2"), "user": []byte("app")},
+		}},
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		out := &bytes.Buffer{}
+		if err := writeDeployPlan(out, plan, format); err != nil {
+			t.Fatal(err)
+		}
+
+		// values are base64 encoded in Data, so check for both forms
+		for _, secret := range []string{"hunter2", "aHVudGVyMg==", "YXBw"} {
+			if strings.Contains(out.String(), secret) {
+				t.Errorf("%s plan shows the secret value %s:\n%s", format, secret, out)
+			}
+		}
+		if !strings.Contains(out.String(), "password") || !strings.Contains(out.String(), redactedValue) {
+			t.Errorf("%s plan doesn't list the redacted keys:\n%s", format, out)
+		}
+	}
+
+	if string(plan.Secrets[0].Data["password"]) != "hunter2" {
+		t.Error("writeDeployPlan changed the plan it was given")
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	secret := v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "db"},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+		StringData: map[string]string{"token": "abc"},
+	}
+
+	redacted := redactSecret(secret)
+	if redacted.Data != nil {
+		t.Errorf("redacted data = %v, want none", redacted.Data)
+	}
+	if len(redacted.StringData) != 2 || redacted.StringData["password"] != redactedValue || redacted.StringData["token"] != redactedValue {
+		t.Errorf("redacted string data = %v", redacted.StringData)
+	}
+	if redacted.Name != "db" || string(secret.Data["password"]) != "hunter2" {
+		t.Errorf("redactSecret changed the secret or dropped its metadata: %+v", secret)
+	}
+
+	if empty := redactSecret(v1.Secret{}); empty.StringData != nil {
+		t.Errorf("an empty secret got string data %v", empty.StringData)
+	}
+}
+
+func TestWriteDeployPlanFormats(t *testing.T) {
+	replicas := int32(2)
+	plan := &deployPlan{
+		Cluster:           "dev",
+		Namespace:         "feature-x",
+		ImageNamespace:    "payments",
+		TemplateNamespace: "template",
+		Images:            []imageResolution{},
+		ConfigMaps: []*v1.ConfigMap{{
+			TypeMeta:   unversioned.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "web-config", Namespace: "feature-x"},
+			Data:       map[string]string{"url": "https://feature-x.ci.example.com"},
+		}},
+		ReplicationControllers: []*v1.ReplicationController{{
+			TypeMeta:   unversioned.TypeMeta{Kind: "ReplicationController", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "feature-x"},
+			Spec:       v1.ReplicationControllerSpec{Replicas: &replicas},
+		}},
+		Layers: [][]string{{"web"}},
+	}
+
+	check := func(format string, rendered deployPlan) {
+		if rendered.Cluster != "dev" || rendered.Namespace != "feature-x" || rendered.ImageNamespace != "payments" {
+			t.Errorf("%s: plan = %+v", format, rendered)
+		}
+		if len(rendered.ConfigMaps) != 1 || rendered.ConfigMaps[0].Data["url"] != "https://feature-x.ci.example.com" {
+			t.Errorf("%s: configmaps = %+v", format, rendered.ConfigMaps)
+		}
+		if len(rendered.ReplicationControllers) != 1 || *rendered.ReplicationControllers[0].Spec.Replicas != 2 ||
+			rendered.ReplicationControllers[0].Kind != "ReplicationController" {
+			t.Errorf("%s: replication controllers = %+v", format, rendered.ReplicationControllers)
+		}
+		if len(rendered.Layers) != 1 || rendered.Layers[0][0] != "web" {
+			t.Errorf("%s: layers = %v", format, rendered.Layers)
+		}
+	}
+
+	for _, format := range []string{"", outputJSON} {
+		out := &bytes.Buffer{}
+		if err := writeDeployPlan(out, plan, format); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(out.String(), "{") {
+			t.Errorf("format %q isn't json: %s", format, out)
+		}
+
+		rendered := deployPlan{}
+		if err := json.Unmarshal(out.Bytes(), &rendered); err != nil {
+			t.Fatalf("format %q: %v", format, err)
+		}
+		check(format, rendered)
+	}
+
+	out := &bytes.Buffer{}
+	if err := writeDeployPlan(out, plan, outputYAML); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "namespace: feature-x\n") {
+		t.Errorf("yaml plan = %s", out)
+	}
+	converted, err := yaml.YAMLToJSON(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := deployPlan{}
+	if err := json.Unmarshal(converted, &rendered); err != nil {
+		t.Fatal(err)
+	}
+	check(outputYAML, rendered)
+
+	if err := writeDeployPlan(&bytes.Buffer{}, plan, "xml"); err == nil {
+		t.Error("writeDeployPlan accepted an unknown format")
+	}
+}
@@ -29,11 +29,12 @@ package main
 import (
 	"log"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	api "k8s.io/client-go/1.4/pkg/api"
 	v1 "k8s.io/client-go/1.4/pkg/api/v1"
 )
 
-func deletePodsByNamespace(namespace string) (*v1.PodList, error) {
+func deletePodsByNamespace(client *kubernetes.Clientset, namespace string) (*v1.PodList, error) {
 	list, err := client.Core().Pods(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -43,13 +44,13 @@ func deletePodsByNamespace(namespace string) (*v1.PodList, error) {
 
 	if len(list.Items) > 0 {
 		for _, pod := range list.Items {
-			deletePod(namespace, pod.ObjectMeta.Name)
+			deletePod(client, namespace, pod.ObjectMeta.Name)
 		}
 	}
 	return list, nil
 }
 
-func deletePod(namespace, podName string) error {
+func deletePod(client *kubernetes.Clientset, namespace, podName string) error {
 	err := client.Core().Pods(namespace).Delete(podName, nil)
 
 	if err != nil {
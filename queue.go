@@ -0,0 +1,322 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// states a queued job moves through
+const (
+	jobQueued     = "queued"
+	jobRunning    = "running"
+	jobDone       = "done"
+	jobSuperseded = "superseded"
+)
+
+// jobResult is the response a finished job sends back to its caller
+type jobResult struct {
+	Code int
+	Body interface{}
+}
+
+// queuedJob is a deploy or delete waiting for, or holding, its branch
+type queuedJob struct {
+	ID       int64      `json:"id"`
+	Cluster  string     `json:"cluster"`
+	Branch   string     `json:"branch"`
+	Action   string     `json:"action"`
+	Caller   string     `json:"caller,omitempty"`
+	State    string     `json:"state"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	key    string
+	run    func() jobResult
+	result jobResult
+	done   chan struct{}
+}
+
+// deployQueue runs one job at a time per branch of a cluster on a bounded pool
+// of workers, a branch has at most one job waiting behind the active one and a
+// newer request replaces it
+type deployQueue struct {
+	sync.Mutex
+	nextID  int64
+	slots   chan struct{}
+	active  map[string]*queuedJob
+	pending map[string]*queuedJob
+}
+
+// queueReport describes the workers and jobs of the queue
+type queueReport struct {
+	Workers int         `json:"workers"`
+	Busy    int         `json:"busy"`
+	Jobs    []queuedJob `json:"jobs"`
+}
+
+// queue of deploys and deletes, created once flags are parsed
+var queue *deployQueue
+
+// newDeployQueue creates a queue with the given number of workers
+func newDeployQueue(workers int) *deployQueue {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &deployQueue{
+		slots:   make(chan struct{}, workers),
+		active:  make(map[string]*queuedJob),
+		pending: make(map[string]*queuedJob),
+	}
+}
+
+// enqueue adds a job for a branch, starting it straight away if the branch is
+// idle and otherwise replacing any job already waiting for the branch
+func (q *deployQueue) enqueue(c *cluster, branchName, action, caller string, run func() jobResult) *queuedJob {
+	q.Lock()
+
+	key := jobKey(c, branchName)
+	q.nextID++
+	job := &queuedJob{
+		ID:      q.nextID,
+		Cluster: c.Name,
+		Branch:  branchName,
+		Action:  action,
+		Caller:  caller,
+		State:   jobQueued,
+		Queued:  time.Now(),
+		key:     key,
+		run:     run,
+		done:    make(chan struct{}),
+	}
+
+	if _, busy := q.active[key]; !busy {
+		q.active[key] = job
+		go q.work(job)
+		q.Unlock()
+		return job
+	}
+
+	previous, superseded := q.pending[key]
+	if superseded {
+		log.Printf("[enqueue] %s of %s (job %d) superseded by %s (job %d)", previous.Action, key, previous.ID, action, job.ID)
+		now := time.Now()
+		previous.State = jobSuperseded
+		previous.Finished = &now
+		close(previous.done)
+	}
+
+	q.pending[key] = job
+	q.Unlock()
+
+	if superseded {
+		audit.record(auditEntry{
+			Caller:  previous.Caller,
+			Cluster: c.Name,
+			Action:  previous.Action,
+			Branch:  branchName,
+			Outcome: auditSuperseded,
+			Error:   fmt.Sprintf("superseded by job %d for %s", job.ID, caller),
+		})
+	}
+
+	return job
+}
+
+// work waits for a free worker, runs the job and then starts the next job
+// waiting for the same branch
+func (q *deployQueue) work(job *queuedJob) {
+	q.slots <- struct{}{}
+
+	q.Lock()
+	started := time.Now()
+	job.State = jobRunning
+	job.Started = &started
+	q.Unlock()
+
+	result := job.run()
+
+	<-q.slots
+
+	q.finish(job, result)
+}
+
+// finish records the result of a running job and starts the next job
+// waiting for the same branch
+func (q *deployQueue) finish(job *queuedJob, result jobResult) {
+	q.Lock()
+	defer q.Unlock()
+
+	finished := time.Now()
+	job.result = result
+	job.State = jobDone
+	job.Finished = &finished
+	close(job.done)
+
+	delete(q.active, job.key)
+	if next, ok := q.pending[job.key]; ok {
+		delete(q.pending, job.key)
+		q.active[job.key] = next
+		go q.work(next)
+	}
+}
+
+// claim marks an idle branch as running a job which the caller runs itself
+// (e.g. an eviction from within a deploy) and hands back to finish, it fails
+// if the branch has a job running or waiting
+func (q *deployQueue) claim(c *cluster, branchName, action, caller string) (*queuedJob, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	key := jobKey(c, branchName)
+	if _, active := q.active[key]; active {
+		return nil, false
+	}
+	if _, pending := q.pending[key]; pending {
+		return nil, false
+	}
+
+	q.nextID++
+	now := time.Now()
+	job := &queuedJob{
+		ID:      q.nextID,
+		Cluster: c.Name,
+		Branch:  branchName,
+		Action:  action,
+		Caller:  caller,
+		State:   jobRunning,
+		Queued:  now,
+		Started: &now,
+		key:     key,
+		done:    make(chan struct{}),
+	}
+	q.active[key] = job
+
+	return job, true
+}
+
+// snapshot copies a job so it can be encoded without holding the lock
+func (q *deployQueue) snapshot(job *queuedJob) queuedJob {
+	q.Lock()
+	defer q.Unlock()
+
+	return *job
+}
+
+// report lists the jobs running and waiting in the queue
+func (q *deployQueue) report() queueReport {
+	q.Lock()
+	defer q.Unlock()
+
+	report := queueReport{
+		Workers: cap(q.slots),
+		Busy:    len(q.slots),
+		Jobs:    []queuedJob{},
+	}
+
+	for _, job := range q.active {
+		report.Jobs = append(report.Jobs, *job)
+	}
+	for _, job := range q.pending {
+		report.Jobs = append(report.Jobs, *job)
+	}
+	sort.Sort(jobsByID(report.Jobs))
+
+	return report
+}
+
+// jobsByID sorts jobs in the order they were queued
+type jobsByID []queuedJob
+
+func (j jobsByID) Len() int           { return len(j) }
+func (j jobsByID) Swap(i, k int)      { j[i], j[k] = j[k], j[i] }
+func (j jobsByID) Less(i, k int) bool { return j[i].ID < j[k].ID }
+
+// writeJobResult responds with the result of a job once it has run, or
+// straight away with the job itself when the caller asked not to wait
+func writeJobResult(w http.ResponseWriter, r *http.Request, job *queuedJob) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if r.FormValue("async") == "true" {
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(queue.snapshot(job)); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	<-job.done
+
+	snapshot := queue.snapshot(job)
+	if snapshot.State == jobSuperseded {
+		w.WriteHeader(http.StatusConflict)
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	w.WriteHeader(job.result.Code)
+	if job.result.Body != nil {
+		if err := json.NewEncoder(w).Encode(job.result.Body); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Queue (GET "/queue")
+func queueRoute(w http.ResponseWriter, r *http.Request) {
+	listed, ok := authorizeListing(w, r)
+	if !ok {
+		return
+	}
+
+	// only the jobs of clusters the caller may read are listed
+	names := clusterNames(listed)
+	report := queue.report()
+	jobs := []queuedJob{}
+	for _, job := range report.Jobs {
+		if contains(names, job.Cluster) {
+			jobs = append(jobs, job)
+		}
+	}
+	report.Jobs = jobs
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		panic(err)
+	}
+}
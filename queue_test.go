@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeployQueueClaim(t *testing.T) {
+	defer func(q *deployQueue, a *auditLog) { queue, audit = q, a }(queue, audit)
+	queue = newDeployQueue(2)
+	audit = &auditLog{history: 10}
+
+	dev := &cluster{Name: "dev"}
+	qa := &cluster{Name: "qa"}
+
+	evicting, ok := queue.claim(dev, "feature-x", actionDelete, "evicted for feature-y")
+	if !ok {
+		t.Fatal("claiming an idle branch failed")
+	}
+	if _, ok := queue.claim(dev, "feature-x", actionDelete, "evicted for feature-z"); ok {
+		t.Error("claimed a branch which is already claimed")
+	}
+	if _, ok := queue.claim(qa, "feature-x", actionDelete, "evicted for feature-z"); !ok {
+		t.Error("claiming the same branch on another cluster failed")
+	}
+
+	ran := make(chan struct{})
+	deploy := queue.enqueue(dev, "feature-x", actionDeploy, "ci", func() jobResult {
+		close(ran)
+		return jobResult{Code: http.StatusOK}
+	})
+
+	select {
+	case <-ran:
+		t.Fatal("a deploy ran while its branch was being evicted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	queue.finish(evicting, jobResult{Code: http.StatusOK})
+
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("the deploy waiting behind an eviction didn't run once it finished")
+	}
+	<-deploy.done
+
+	if _, ok := queue.claim(dev, "feature-x", actionDelete, "evicted for feature-y"); !ok {
+		t.Error("claiming the branch once it was idle again failed")
+	}
+}
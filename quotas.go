@@ -0,0 +1,397 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	inf "gopkg.in/inf.v0"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// names of the quota and limit range emmie creates from its own configuration
+const (
+	quotaName      = "emmie-quota"
+	limitRangeName = "emmie-limits"
+)
+
+// quotaConfig is the quota and limit range applied to every branch namespace
+type quotaConfig struct {
+	ResourceQuota *v1.ResourceQuotaSpec `json:"resourceQuota,omitempty"`
+	LimitRange    *v1.LimitRangeSpec    `json:"limitRange,omitempty"`
+}
+
+// quota configuration loaded at startup
+var branchQuota quotaConfig
+
+// loadQuotaConfig reads the quota file and applies the quota flag over it
+func loadQuotaConfig() error {
+	if *argQuotaConfig != "" {
+		data, err := ioutil.ReadFile(*argQuotaConfig)
+		if err != nil {
+			return err
+		}
+
+		if err := yaml.Unmarshal(data, &branchQuota); err != nil {
+			return fmt.Errorf("invalid quota config: %v", err)
+		}
+	}
+
+	if *argQuota != "" {
+		hard, err := parseResourceList(*argQuota)
+		if err != nil {
+			return err
+		}
+
+		if branchQuota.ResourceQuota == nil {
+			branchQuota.ResourceQuota = &v1.ResourceQuotaSpec{}
+		}
+		if branchQuota.ResourceQuota.Hard == nil {
+			branchQuota.ResourceQuota.Hard = v1.ResourceList{}
+		}
+		for name, quantity := range hard {
+			branchQuota.ResourceQuota.Hard[name] = quantity
+		}
+	}
+
+	return nil
+}
+
+// parseResourceList parses a list of resources like "pods=20,limits.memory=8Gi"
+func parseResourceList(value string) (v1.ResourceList, error) {
+	list := v1.ResourceList{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid resource %q, expected name=quantity", item)
+		}
+
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity for %s: %v", parts[0], err)
+		}
+		list[v1.ResourceName(strings.TrimSpace(parts[0]))] = quantity
+	}
+
+	return list, nil
+}
+
+// namespaceQuotas renders the quotas and limit ranges for a branch namespace
+// from emmie's configuration and, if enabled, the template namespace
+func namespaceQuotas(client *kubernetes.Clientset, templateNamespace, namespace string) ([]*v1.ResourceQuota, []*v1.LimitRange, error) {
+	quotas := []*v1.ResourceQuota{}
+	limitRanges := []*v1.LimitRange{}
+
+	if branchQuota.ResourceQuota != nil {
+		quotas = append(quotas, &v1.ResourceQuota{
+			TypeMeta:   unversioned.TypeMeta{Kind: "ResourceQuota", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: quotaName, Namespace: namespace},
+			Spec:       *branchQuota.ResourceQuota,
+		})
+	}
+
+	if branchQuota.LimitRange != nil {
+		limitRanges = append(limitRanges, &v1.LimitRange{
+			TypeMeta:   unversioned.TypeMeta{Kind: "LimitRange", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: limitRangeName, Namespace: namespace},
+			Spec:       *branchQuota.LimitRange,
+		})
+	}
+
+	if !*argTemplateQuotas {
+		return quotas, limitRanges, nil
+	}
+
+	templateQuotas, err := listResourceQuotasByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, quota := range templateQuotas.Items {
+		quotas = append(quotas, &v1.ResourceQuota{
+			TypeMeta:   unversioned.TypeMeta{Kind: "ResourceQuota", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: quota.Name, Namespace: namespace, Labels: quota.Labels},
+			Spec:       quota.Spec,
+		})
+	}
+
+	templateLimitRanges, err := listLimitRangesByNamespace(client, templateNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, limitRange := range templateLimitRanges.Items {
+		limitRanges = append(limitRanges, &v1.LimitRange{
+			TypeMeta:   unversioned.TypeMeta{Kind: "LimitRange", APIVersion: "v1"},
+			ObjectMeta: v1.ObjectMeta{Name: limitRange.Name, Namespace: namespace, Labels: limitRange.Labels},
+			Spec:       limitRange.Spec,
+		})
+	}
+
+	return quotas, limitRanges, nil
+}
+
+// checkQuota adds up the resources the plan's workloads would request, along
+// with the largest hook since hooks run one at a time, and reports any quota
+// in the plan they would exceed
+func checkQuota(plan *deployPlan) []string {
+	if len(plan.ResourceQuotas) == 0 {
+		return nil
+	}
+
+	usage := v1.ResourceList{}
+	for _, rc := range plan.ReplicationControllers {
+		if rc.Spec.Template != nil {
+			addPodUsage(usage, rc.Spec.Template.Spec, desiredReplicas(rc.Spec.Replicas), plan.LimitRanges)
+		}
+	}
+	for _, deployment := range plan.Deployments {
+		addPodUsage(usage, deployment.Spec.Template.Spec, desiredReplicas(deployment.Spec.Replicas), plan.LimitRanges)
+	}
+
+	largestHook := v1.ResourceList{}
+	for _, hook := range plan.Hooks {
+		hookUsage := v1.ResourceList{}
+		addPodUsage(hookUsage, hook.Spec.Template.Spec, desiredReplicas(hook.Spec.Parallelism), plan.LimitRanges)
+		for name, quantity := range hookUsage {
+			if largest, ok := largestHook[name]; !ok || quantity.Cmp(largest) > 0 {
+				largestHook[name] = quantity
+			}
+		}
+	}
+	for name, quantity := range largestHook {
+		addQuantity(usage, name, quantity)
+	}
+
+	errors := []string{}
+	for _, quota := range plan.ResourceQuotas {
+		names := []string{}
+		for name := range quota.Spec.Hard {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			hard := quota.Spec.Hard[v1.ResourceName(name)]
+			used, ok := usage[v1.ResourceName(name)]
+			if ok && used.Cmp(hard) > 0 {
+				errors = append(errors, fmt.Sprintf("ResourceQuota/%s: %s of %s exceeds the quota of %s", quota.Name, name, used.String(), hard.String()))
+			}
+		}
+	}
+
+	return errors
+}
+
+// addPodUsage adds the resources of replicas copies of a pod to usage,
+// containers without requests or limits get the defaults of the limit ranges
+func addPodUsage(usage v1.ResourceList, spec v1.PodSpec, replicas int32, limitRanges []*v1.LimitRange) {
+	if replicas <= 0 {
+		return
+	}
+
+	addQuantity(usage, v1.ResourcePods, *resource.NewQuantity(int64(replicas), resource.DecimalSI))
+
+	for _, container := range spec.Containers {
+		limits, requests := containerResources(container, limitRanges)
+
+		for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+			if quantity, ok := requests[name]; ok {
+				total := multiplyQuantity(quantity, replicas)
+				addQuantity(usage, name, total)
+				addQuantity(usage, v1.ResourceName("requests."+string(name)), total)
+			}
+			if quantity, ok := limits[name]; ok {
+				addQuantity(usage, v1.ResourceName("limits."+string(name)), multiplyQuantity(quantity, replicas))
+			}
+		}
+	}
+}
+
+// multiplyQuantity returns quantity times n, keeping the quantity's format
+func multiplyQuantity(quantity resource.Quantity, n int32) resource.Quantity {
+	product := new(inf.Dec).Mul(quantity.Copy().AsDec(), inf.NewDec(int64(n), 0))
+
+	multiplied, err := resource.ParseQuantity(product.String())
+	if err != nil {
+		log.Println("[multiplyQuantity] Error multiplying quantity:", err)
+		return quantity
+	}
+	multiplied.Format = quantity.Format
+
+	// adding to a zero quantity drops the parsed string, so the product is
+	// printed in canonical form (1500m rather than 1.500)
+	result := resource.Quantity{}
+	result.Add(multiplied)
+	return result
+}
+
+// containerResources works out the limits and requests a container ends up
+// with once limit range defaults are applied
+func containerResources(container v1.Container, limitRanges []*v1.LimitRange) (v1.ResourceList, v1.ResourceList) {
+	limits := v1.ResourceList{}
+	requests := v1.ResourceList{}
+
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != v1.LimitTypeContainer {
+				continue
+			}
+			for name, quantity := range item.Default {
+				limits[name] = quantity
+			}
+			for name, quantity := range item.DefaultRequest {
+				requests[name] = quantity
+			}
+		}
+	}
+
+	for name, quantity := range container.Resources.Limits {
+		limits[name] = quantity
+	}
+	for name, quantity := range container.Resources.Requests {
+		requests[name] = quantity
+	}
+
+	// requests default to the limits when they aren't set
+	for name, quantity := range limits {
+		if _, ok := requests[name]; !ok {
+			requests[name] = quantity
+		}
+	}
+
+	return limits, requests
+}
+
+// addQuantity adds a quantity to a resource in a list
+func addQuantity(list v1.ResourceList, name v1.ResourceName, quantity resource.Quantity) {
+	total, ok := list[name]
+	if !ok {
+		list[name] = *quantity.Copy()
+		return
+	}
+
+	total.Add(quantity)
+	list[name] = total
+}
+
+func listResourceQuotasByNamespace(client *kubernetes.Clientset, namespace string) (*v1.ResourceQuotaList, error) {
+	list, err := client.Core().ResourceQuotas(namespace).List(api.ListOptions{})
+
+	if err != nil {
+		log.Println("[listResourceQuotasByNamespace] Error listing ResourceQuotas", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+func createResourceQuota(client *kubernetes.Clientset, namespace string, quota *v1.ResourceQuota) error {
+	_, err := client.Core().ResourceQuotas(namespace).Create(quota)
+
+	if err != nil {
+		log.Println("[createResourceQuota] Error creating ResourceQuota:", err)
+	}
+	return err
+}
+
+func deleteResourceQuota(client *kubernetes.Clientset, namespace, name string) error {
+	err := client.Core().ResourceQuotas(namespace).Delete(name, nil)
+
+	if err != nil {
+		log.Println("[deleteResourceQuota] Error deleting ResourceQuota:", err)
+	}
+	return err
+}
+
+func listLimitRangesByNamespace(client *kubernetes.Clientset, namespace string) (*v1.LimitRangeList, error) {
+	list, err := client.Core().LimitRanges(namespace).List(api.ListOptions{})
+
+	if err != nil {
+		log.Println("[listLimitRangesByNamespace] Error listing LimitRanges", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+func createLimitRange(client *kubernetes.Clientset, namespace string, limitRange *v1.LimitRange) error {
+	_, err := client.Core().LimitRanges(namespace).Create(limitRange)
+
+	if err != nil {
+		log.Println("[createLimitRange] Error creating LimitRange:", err)
+	}
+	return err
+}
+
+func deleteLimitRange(client *kubernetes.Clientset, namespace, name string) error {
+	err := client.Core().LimitRanges(namespace).Delete(name, nil)
+
+	if err != nil {
+		log.Println("[deleteLimitRange] Error deleting LimitRange:", err)
+	}
+	return err
+}
+
+// replaceNamespaceQuotas removes any quotas and limit ranges in a namespace
+// and creates the ones in the plan
+func replaceNamespaceQuotas(plan *deployPlan) {
+	namespace := plan.Namespace
+	client := plan.cluster.client
+
+	if quotas, err := listResourceQuotasByNamespace(client, namespace); err == nil {
+		for _, quota := range quotas.Items {
+			deleteResourceQuota(client, namespace, quota.Name)
+		}
+	}
+
+	if limitRanges, err := listLimitRangesByNamespace(client, namespace); err == nil {
+		for _, limitRange := range limitRanges.Items {
+			deleteLimitRange(client, namespace, limitRange.Name)
+		}
+	}
+
+	for _, quota := range plan.ResourceQuotas {
+		createResourceQuota(client, namespace, quota)
+	}
+
+	for _, limitRange := range plan.LimitRanges {
+		createLimitRange(client, namespace, limitRange)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+)
+
+// podSpec is a pod with one container requesting cpu and limiting memory
+func podSpec(cpu, memory string) v1.PodSpec {
+	return v1.PodSpec{
+		Containers: []v1.Container{{
+			Name: "app",
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)},
+				Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse(memory)},
+			},
+		}},
+	}
+}
+
+func TestAddPodUsage(t *testing.T) {
+	tests := []struct {
+		replicas int32
+		want     map[v1.ResourceName]string
+	}{
+		{replicas: 0, want: map[v1.ResourceName]string{}},
+		{replicas: 1, want: map[v1.ResourceName]string{
+			v1.ResourcePods: "1", v1.ResourceCPU: "250m", "requests.cpu": "250m",
+			v1.ResourceMemory: "512Mi", "requests.memory": "512Mi", "limits.memory": "512Mi",
+		}},
+		{replicas: 3, want: map[v1.ResourceName]string{
+			v1.ResourcePods: "3", v1.ResourceCPU: "750m", "requests.cpu": "750m",
+			v1.ResourceMemory: "1536Mi", "requests.memory": "1536Mi", "limits.memory": "1536Mi",
+		}},
+	}
+
+	for _, test := range tests {
+		usage := v1.ResourceList{}
+		addPodUsage(usage, podSpec("250m", "512Mi"), test.replicas, nil)
+
+		if len(usage) != len(test.want) {
+			t.Errorf("%d replicas: usage = %v, want %v", test.replicas, usage, test.want)
+			continue
+		}
+		for name, want := range test.want {
+			got := usage[name]
+			if got.Cmp(resource.MustParse(want)) != 0 {
+				t.Errorf("%d replicas: %s = %s, want %s", test.replicas, name, got.String(), want)
+			}
+		}
+	}
+}
+
+func TestAddPodUsageManyReplicas(t *testing.T) {
+	started := time.Now()
+
+	usage := v1.ResourceList{}
+	addPodUsage(usage, podSpec("1", "1Gi"), 2000000000, nil)
+
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("adding up 2000000000 replicas took %v", elapsed)
+	}
+	cpu := usage[v1.ResourceCPU]
+	if cpu.Cmp(resource.MustParse("2000000000")) != 0 {
+		t.Errorf("cpu = %s, want 2000000000", cpu.String())
+	}
+}
+
+func TestCheckQuotaCountsLargestHook(t *testing.T) {
+	replicas := int32(2)
+	parallelism := int32(2)
+
+	plan := &deployPlan{
+		ResourceQuotas: []*v1.ResourceQuota{{
+			ObjectMeta: v1.ObjectMeta{Name: quotaName},
+			Spec:       v1.ResourceQuotaSpec{Hard: v1.ResourceList{v1.ResourcePods: resource.MustParse("4")}},
+		}},
+		ReplicationControllers: []*v1.ReplicationController{{
+			Spec: v1.ReplicationControllerSpec{
+				Replicas: &replicas,
+				Template: &v1.PodTemplateSpec{Spec: podSpec("100m", "128Mi")},
+			},
+		}},
+		Hooks: []*batchv1.Job{
+			{Spec: batchv1.JobSpec{Template: v1.PodTemplateSpec{Spec: podSpec("100m", "128Mi")}}},
+			{Spec: batchv1.JobSpec{Parallelism: &parallelism, Template: v1.PodTemplateSpec{Spec: podSpec("100m", "128Mi")}}},
+		},
+	}
+
+	if errors := checkQuota(plan); len(errors) != 0 {
+		t.Errorf("checkQuota = %v, want 4 pods to fit", errors)
+	}
+
+	plan.ResourceQuotas[0].Spec.Hard[v1.ResourcePods] = resource.MustParse("3")
+	if errors := checkQuota(plan); len(errors) != 1 {
+		t.Errorf("checkQuota = %v, want the largest hook to push pods over 3", errors)
+	}
+}
+
+func TestCheckQuotaWithParsedOverrides(t *testing.T) {
+	overrides, err := parseOverrides([]byte("workloads:\n  web:\n    replicas: 3\n    containers:\n      web:\n        resources:\n          requests:\n            cpu: 500m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, _ := overrides.workload("web")
+
+	rc := &v1.ReplicationController{
+		Spec: v1.ReplicationControllerSpec{
+			Replicas: override.Replicas,
+			Template: &v1.PodTemplateSpec{Spec: podSpec("100m", "128Mi")},
+		},
+	}
+	applyContainerOverride(&rc.Spec.Template.Spec.Containers[0], override.Containers["web"])
+
+	plan := &deployPlan{
+		ResourceQuotas: []*v1.ResourceQuota{{
+			ObjectMeta: v1.ObjectMeta{Name: quotaName},
+			Spec:       v1.ResourceQuotaSpec{Hard: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+		}},
+		ReplicationControllers: []*v1.ReplicationController{rc},
+	}
+
+	errors := checkQuota(plan)
+	if len(errors) != 1 || !strings.Contains(errors[0], "cpu of 1500m exceeds the quota of 1") {
+		t.Errorf("checkQuota = %v, want 3 replicas of 500m to exceed 1 cpu", errors)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// how long a client's buckets are kept after its last request
+const rateLimitIdle = 10 * time.Minute
+
+// limitedClient is the token buckets of one token or address
+type limitedClient struct {
+	all         *ratelimit.Bucket
+	destructive *ratelimit.Bucket
+	lastSeen    time.Time
+}
+
+// rateLimiter keeps a bucket per token and per client address for every
+// request, and a second smaller one for deploys and deletes
+type rateLimiter struct {
+	sync.Mutex
+	clients  map[string]*limitedClient
+	rejected map[string]int64
+}
+
+// limiter of API calls, nil when rate-limit is 0
+var limiter *rateLimiter
+
+// newRateLimiter creates a limiter and starts dropping idle clients
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{
+		clients:  make(map[string]*limitedClient),
+		rejected: make(map[string]int64),
+	}
+	go l.sweep()
+	return l
+}
+
+// sweep forgets clients which haven't made a request for a while
+func (l *rateLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		l.Lock()
+		for key, c := range l.clients {
+			if time.Since(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+// client finds or creates the buckets for a key
+func (l *rateLimiter) client(key string) *limitedClient {
+	c, ok := l.clients[key]
+	if !ok {
+		c = &limitedClient{all: ratelimit.NewBucketWithRate(*argRateLimit, int64(*argRateBurst))}
+		if *argDestructiveRate > 0 {
+			c.destructive = ratelimit.NewBucketWithRate(*argDestructiveRate, int64(*argDestructiveBurst))
+		}
+		l.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c
+}
+
+// allow takes a token from every bucket of the request's clients, or from
+// none of them when one is empty, returning how long to wait before retrying
+func (l *rateLimiter) allow(keys []string, destructive bool) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	// buckets are only used under the lock, so every one is checked before
+	// any is taken from and a refused request costs its clients nothing
+	buckets := []*ratelimit.Bucket{}
+	for _, key := range keys {
+		c := l.client(key)
+
+		if c.all.Available() < 1 {
+			l.rejected[kindOf(key)+",all"]++
+			return retryAfter(c.all), false
+		}
+		buckets = append(buckets, c.all)
+
+		if destructive && c.destructive != nil {
+			if c.destructive.Available() < 1 {
+				l.rejected[kindOf(key)+",destructive"]++
+				return retryAfter(c.destructive), false
+			}
+			buckets = append(buckets, c.destructive)
+		}
+	}
+
+	for _, bucket := range buckets {
+		bucket.TakeAvailable(1)
+	}
+	return 0, true
+}
+
+// retryAfter is how long a bucket takes to refill a single token
+func retryAfter(bucket *ratelimit.Bucket) time.Duration {
+	return time.Duration(float64(time.Second) / bucket.Rate())
+}
+
+// kindOf is whether a client key is for a token or an address
+func kindOf(key string) string {
+	return key[:strings.Index(key, ":")]
+}
+
+// rateLimitKeys are the clients a request counts against, its token (hashed
+// so it isn't kept in memory) and its address
+func rateLimitKeys(r *http.Request) []string {
+	keys := []string{"ip:" + clientIP(r)}
+
+	// only the header and query string are read, the body belongs to the route
+	token := ""
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		token = strings.TrimSpace(header[7:])
+	} else if *argQueryToken {
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" {
+		keys = append(keys, fmt.Sprintf("token:%x", sha256.Sum256([]byte(token))))
+	}
+
+	return keys
+}
+
+// clientIP is the address of the caller, taken from X-Forwarded-For when
+// emmie runs behind a proxy which sets it. Only the right-most entry, added
+// by the proxy itself, is used; the ones before it are whatever the client sent
+func clientIP(r *http.Request) string {
+	if *argTrustForwarded {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isDestructive checks whether a request deploys or deletes an environment,
+// dry runs only read the cluster so they count as reads. Only the query
+// string is checked for dryRun, the body belongs to the route
+func isDestructive(r *http.Request) bool {
+	if r.Method == "POST" && r.URL.Query().Get("dryRun") == "true" {
+		return false
+	}
+	return r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE"
+}
+
+// limit refuses requests over the rate limits with 429 and Retry-After
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := l.allow(rateLimitKeys(r), isDestructive(r))
+		if !ok {
+			log.Printf("[rateLimiter] Refusing %s %s from %s", r.Method, redactURL(r.URL), clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Metrics (GET "/metrics")
+func metricsRoute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintln(w, "# HELP emmie_rate_limited_total Requests refused by the rate limits.")
+	fmt.Fprintln(w, "# TYPE emmie_rate_limited_total counter")
+	if limiter == nil {
+		return
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	series := []string{}
+	for key := range limiter.rejected {
+		series = append(series, key)
+	}
+	sort.Strings(series)
+
+	for _, s := range series {
+		parts := strings.Split(s, ",")
+		fmt.Fprintf(w, "emmie_rate_limited_total{client=%q,limit=%q} %d\n", parts[0], parts[1], limiter.rejected[s])
+	}
+}
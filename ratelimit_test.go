@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool) { *argTrustForwarded = trust }(*argTrustForwarded)
+
+	tests := []struct {
+		trust      bool
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{trust: false, remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{trust: false, remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.7", want: "10.0.0.1"},
+		{trust: true, remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{trust: true, remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.7", want: "203.0.113.7"},
+		{trust: true, remoteAddr: "10.0.0.1:1234", forwarded: "1.2.3.4, 203.0.113.7", want: "203.0.113.7"},
+		{trust: true, remoteAddr: "10.0.0.1:1234", forwarded: "1.2.3.4,", want: "10.0.0.1"},
+		{trust: true, remoteAddr: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{trust: false, remoteAddr: "unix", want: "unix"},
+	}
+
+	for _, test := range tests {
+		*argTrustForwarded = test.trust
+		r := httptest.NewRequest("GET", "/deploy", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if got := clientIP(r); got != test.want {
+			t.Errorf("clientIP(%s, %q) with trust=%v = %s, want %s", test.remoteAddr, test.forwarded, test.trust, got, test.want)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	defer func(rate, destructiveRate float64, burst, destructiveBurst int) {
+		*argRateLimit, *argDestructiveRate, *argRateBurst, *argDestructiveBurst = rate, destructiveRate, burst, destructiveBurst
+	}(*argRateLimit, *argDestructiveRate, *argRateBurst, *argDestructiveBurst)
+
+	// slow enough that no bucket refills during the test
+	*argRateLimit, *argRateBurst = 0.001, 2
+	*argDestructiveRate, *argDestructiveBurst = 0.001, 1
+
+	l := &rateLimiter{clients: make(map[string]*limitedClient), rejected: make(map[string]int64)}
+
+	steps := []struct {
+		keys        []string
+		destructive bool
+		want        bool
+	}{
+		{keys: []string{"ip:a", "token:1"}, destructive: true, want: true},
+		// the destructive bucket of ip:a is empty, its all bucket keeps a token
+		{keys: []string{"ip:a", "token:1"}, destructive: true, want: false},
+		{keys: []string{"ip:a", "token:1"}, want: true},
+		{keys: []string{"ip:a", "token:1"}, want: false},
+		// refused by ip:a, which mustn't cost token:2 anything
+		{keys: []string{"ip:a", "token:2"}, want: false},
+		{keys: []string{"ip:b", "token:2"}, destructive: true, want: true},
+		{keys: []string{"ip:c", "token:2"}, want: true},
+		{keys: []string{"ip:d", "token:2"}, want: false},
+	}
+
+	for i, step := range steps {
+		wait, ok := l.allow(step.keys, step.destructive)
+		if ok != step.want {
+			t.Errorf("step %d: allow(%v, %v) = %v, want %v", i, step.keys, step.destructive, ok, step.want)
+		}
+		if !ok && wait <= 0 {
+			t.Errorf("step %d: refused without a retry time", i)
+		}
+	}
+
+	want := map[string]int64{"ip,destructive": 1, "ip,all": 2, "token,all": 1}
+	for series, count := range want {
+		if l.rejected[series] != count {
+			t.Errorf("rejected[%s] = %d, want %d", series, l.rejected[series], count)
+		}
+	}
+}
+
+func TestIsDestructive(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   bool
+	}{
+		{method: "GET", url: "/deploy/feature-x/status", want: false},
+		{method: "POST", url: "/deploy/team/feature-x", want: true},
+		{method: "POST", url: "/deploy/team/feature-x?dryRun=true", want: false},
+		{method: "POST", url: "/deploy/team/feature-x?dryRun=false", want: true},
+		{method: "PUT", url: "/deploy/team/feature-x?dryRun=true", want: true},
+		{method: "DELETE", url: "/deploy/feature-x", want: true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if got := isDestructive(r); got != test.want {
+			t.Errorf("isDestructive(%s %s) = %v, want %v", test.method, test.url, got, test.want)
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -44,7 +45,7 @@ func getReplicationControllerRoute(w http.ResponseWriter, r *http.Request) {
 	rcName := vars["rcName"]
 	namespace := vars["namespace"]
 
-	rc, err := getReplicationController(rcName, namespace)
+	rc, err := getReplicationController(defaultCluster.client, rcName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +65,7 @@ func getReplicationControllersRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	rc, err := listReplicationControllers(namespace, key, value)
+	rc, err := listReplicationControllers(defaultCluster.client, namespace, key, value)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +83,7 @@ func getReplicationControllersRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listReplicationControllersByNamespace(namespace string) (*v1.ReplicationControllerList, error) {
+func listReplicationControllersByNamespace(client *kubernetes.Clientset, namespace string) (*v1.ReplicationControllerList, error) {
 	list, err := client.Core().ReplicationControllers(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -92,7 +93,7 @@ func listReplicationControllersByNamespace(namespace string) (*v1.ReplicationCon
 	return list, nil
 }
 
-func listReplicationControllers(namespace, labelKey, labelValue string) (*v1.ReplicationControllerList, error) {
+func listReplicationControllers(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1.ReplicationControllerList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Core().ReplicationControllers(namespace).List(listOptions)
@@ -104,7 +105,7 @@ func listReplicationControllers(namespace, labelKey, labelValue string) (*v1.Rep
 	return list, nil
 }
 
-func getReplicationController(replicationControllerName, namespace string) (*v1.ReplicationController, error) {
+func getReplicationController(client *kubernetes.Clientset, replicationControllerName, namespace string) (*v1.ReplicationController, error) {
 	rc, err := client.Core().ReplicationControllers(namespace).Get(replicationControllerName)
 
 	if err != nil {
@@ -114,7 +115,7 @@ func getReplicationController(replicationControllerName, namespace string) (*v1.
 	return rc, nil
 }
 
-func createReplicationController(namespace string, rc *v1.ReplicationController) error {
+func createReplicationController(client *kubernetes.Clientset, namespace string, rc *v1.ReplicationController) error {
 	_, err := client.Core().ReplicationControllers(namespace).Create(rc)
 
 	if err != nil {
@@ -123,7 +124,7 @@ func createReplicationController(namespace string, rc *v1.ReplicationController)
 	return err
 }
 
-func deleteReplicationController(namespace, name string) error {
+func deleteReplicationController(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: Use nil?
 	err := client.ReplicationControllers(namespace).Delete(name, nil)
 
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	apierrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annotation on a template secret listing keys to generate for each branch
+const generateAnnotation = "emmie-generate"
+
+// length and alphabet of generated secret values
+const (
+	generatedLength   = 32
+	generatedAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// generatedKeys lists the keys named by the emmie-generate annotation
+func generatedKeys(annotations map[string]string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(annotations[generateAnnotation], ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// branchSecretData copies the data of a template secret, replacing the keys it
+// asks to generate with random values, values already in the branch are kept
+// so redeploys don't change them. Values are only generated afresh when the
+// branch has no copy of the secret, not when it can't be read
+func branchSecretData(client *kubernetes.Clientset, secret v1.Secret, namespace string) (map[string][]byte, error) {
+	if len(generatedKeys(secret.Annotations)) == 0 {
+		return secret.Data, nil
+	}
+
+	existing := map[string][]byte{}
+	current, err := getSecret(client, secret.Name, namespace)
+	if err == nil {
+		existing = current.Data
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("reading generated values of secret %s: %v", secret.Name, err)
+	}
+
+	return generateSecretData(secret, existing)
+}
+
+// generateSecretData fills in the generated keys of a template secret, keeping
+// the values in existing
+func generateSecretData(secret v1.Secret, existing map[string][]byte) (map[string][]byte, error) {
+	keys := generatedKeys(secret.Annotations)
+
+	data := make(map[string][]byte, len(secret.Data)+len(keys))
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+
+	for _, key := range keys {
+		if value, ok := existing[key]; ok && len(value) > 0 {
+			data[key] = value
+			continue
+		}
+
+		value, err := randomValue(generatedLength)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = []byte(value)
+	}
+
+	return data, nil
+}
+
+// mergeSecretData returns a copy of data with values added
+func mergeSecretData(data, values map[string][]byte) map[string][]byte {
+	merged := make(map[string][]byte, len(data)+len(values))
+	for key, value := range data {
+		merged[key] = value
+	}
+	for key, value := range values {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// randomValue creates a random alphanumeric string
+func randomValue(length int) (string, error) {
+	max := big.NewInt(int64(len(generatedAlphabet)))
+	value := make([]byte, length)
+
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		value[i] = generatedAlphabet[n.Int64()]
+	}
+
+	return string(value), nil
+}
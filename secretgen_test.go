@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/rest"
+)
+
+func TestGeneratedKeys(t *testing.T) {
+	keys := generatedKeys(map[string]string{generateAnnotation: " password, ,apiKey "})
+	if len(keys) != 2 || keys[0] != "password" || keys[1] != "apiKey" {
+		t.Errorf("generatedKeys = %v", keys)
+	}
+	if keys := generatedKeys(nil); len(keys) != 0 {
+		t.Errorf("generatedKeys(nil) = %v", keys)
+	}
+}
+
+func TestGenerateSecretData(t *testing.T) {
+	template := v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "db", Annotations: map[string]string{generateAnnotation: "password,apiKey,token"}},
+		Data:       map[string][]byte{"user": []byte("app"), "password": []byte("template")},
+	}
+	existing := map[string][]byte{"password": []byte("kept"), "token": []byte("")}
+
+	data, err := generateSecretData(template, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data["user"]) != "app" {
+		t.Errorf("user = %q, want the template value", data["user"])
+	}
+	if string(data["password"]) != "kept" {
+		t.Errorf("password = %q, want the value the branch already has", data["password"])
+	}
+	for _, key := range []string{"apiKey", "token"} {
+		if len(data[key]) != generatedLength || strings.Trim(string(data[key]), generatedAlphabet) != "" {
+			t.Errorf("%s = %q, want a new %d character value", key, data[key], generatedLength)
+		}
+	}
+	if string(template.Data["password"]) != "template" {
+		t.Error("generateSecretData changed the template secret")
+	}
+
+	again, err := generateSecretData(template, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range data {
+		if string(again[key]) != string(value) {
+			t.Errorf("%s changed on a redeploy: %q, was %q", key, again[key], value)
+		}
+	}
+}
+
+func TestBranchSecretDataOnlyGeneratesMissingSecrets(t *testing.T) {
+	// a stub api server answering for the branch copy of the secret
+	responses := map[string]struct {
+		code int
+		body string
+	}{
+		"existing":  {code: http.StatusOK, body: `{"kind":"Secret","apiVersion":"v1","metadata":{"name":"db"},"data":{"password":"a2VwdA=="}}`},
+		"missing":   {code: http.StatusNotFound, body: `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`},
+		"forbidden": {code: http.StatusForbidden, body: `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403}`},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")[0]
+		response := responses[namespace]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.code)
+		w.Write([]byte(response.body))
+	}))
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "db", Annotations: map[string]string{generateAnnotation: "password"}},
+	}
+
+	data, err := branchSecretData(client, template, "existing")
+	if err != nil || string(data["password"]) != "kept" {
+		t.Errorf("existing branch: password = %q, error %v, want the kept value", data["password"], err)
+	}
+
+	data, err = branchSecretData(client, template, "missing")
+	if err != nil || len(data["password"]) != generatedLength {
+		t.Errorf("new branch: password = %q, error %v, want a generated value", data["password"], err)
+	}
+
+	if _, err := branchSecretData(client, template, "forbidden"); err == nil {
+		t.Error("a secret which couldn't be read got new values")
+	}
+}
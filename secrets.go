@@ -33,18 +33,42 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/fields"
 	"k8s.io/client-go/1.4/pkg/labels"
 )
 
+// redactedValue stands in for secret values in dry runs and exported manifests
+const redactedValue = "REDACTED"
+
+// redactSecret returns a copy of a secret with every value replaced, keeping
+// the keys so callers can still see what the secret holds
+func redactSecret(secret v1.Secret) v1.Secret {
+	values := map[string]string{}
+	for key := range secret.Data {
+		values[key] = redactedValue
+	}
+	for key := range secret.StringData {
+		values[key] = redactedValue
+	}
+
+	redacted := secret
+	redacted.Data = nil
+	redacted.StringData = nil
+	if len(values) > 0 {
+		redacted.StringData = values
+	}
+	return redacted
+}
+
 func getSecretRoute(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	secretName := vars["secretName"]
 	namespace := vars["namespace"]
 
-	secret, err := getSecret(secretName, namespace)
+	secret, err := getSecret(defaultCluster.client, secretName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +88,7 @@ func getSecretsRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	secret, err := listSecrets(namespace, key, value)
+	secret, err := listSecrets(defaultCluster.client, namespace, key, value)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +106,7 @@ func getSecretsRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listSecretsByNamespace(namespace string) (*v1.SecretList, error) {
+func listSecretsByNamespace(client *kubernetes.Clientset, namespace string) (*v1.SecretList, error) {
 	list, err := client.Core().Secrets(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -97,7 +121,7 @@ func listSecretsByNamespace(namespace string) (*v1.SecretList, error) {
 	return list, nil
 }
 
-func listSecrets(namespace, labelKey, labelValue string) (*v1.SecretList, error) {
+func listSecrets(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1.SecretList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Core().Secrets(namespace).List(listOptions)
@@ -114,7 +138,7 @@ func listSecrets(namespace, labelKey, labelValue string) (*v1.SecretList, error)
 	return list, nil
 }
 
-func getSecret(secretName, namespace string) (*v1.Secret, error) {
+func getSecret(client *kubernetes.Clientset, secretName, namespace string) (*v1.Secret, error) {
 	svc, err := client.Core().Secrets(namespace).Get(secretName)
 
 	if err != nil {
@@ -125,7 +149,7 @@ func getSecret(secretName, namespace string) (*v1.Secret, error) {
 	return svc, nil
 }
 
-func createSecret(namespace string, secret *v1.Secret) error {
+func createSecret(client *kubernetes.Clientset, namespace string, secret *v1.Secret) error {
 	_, err := client.Core().Secrets(namespace).Create(secret)
 
 	if err != nil {
@@ -134,7 +158,7 @@ func createSecret(namespace string, secret *v1.Secret) error {
 	return err
 }
 
-func deleteSecret(namespace, name string) error {
+func deleteSecret(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: Use nil?
 	err := client.Secrets(namespace).Delete(name, nil)
 
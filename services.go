@@ -33,6 +33,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/fields"
@@ -44,7 +45,7 @@ func getServiceRoute(w http.ResponseWriter, r *http.Request) {
 	serviceName := vars["serviceName"]
 	namespace := vars["namespace"]
 
-	svc, err := getService(serviceName, namespace)
+	svc, err := getService(defaultCluster.client, serviceName, namespace)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -64,7 +65,7 @@ func getServicesRoute(w http.ResponseWriter, r *http.Request) {
 	value := vars["value"]
 	namespace := vars["namespace"]
 
-	svc, err := listServices(namespace, key, value)
+	svc, err := listServices(defaultCluster.client, namespace, key, value)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -82,7 +83,7 @@ func getServicesRoute(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listServicesByNamespace(namespace string) (*v1.ServiceList, error) {
+func listServicesByNamespace(client *kubernetes.Clientset, namespace string) (*v1.ServiceList, error) {
 	list, err := client.Core().Services(namespace).List(api.ListOptions{})
 
 	if err != nil {
@@ -97,7 +98,7 @@ func listServicesByNamespace(namespace string) (*v1.ServiceList, error) {
 	return list, nil
 }
 
-func listServices(namespace, labelKey, labelValue string) (*v1.ServiceList, error) {
+func listServices(client *kubernetes.Clientset, namespace, labelKey, labelValue string) (*v1.ServiceList, error) {
 	selector := labels.Set{labelKey: labelValue}.AsSelector()
 	listOptions := api.ListOptions{FieldSelector: fields.Everything(), LabelSelector: selector}
 	list, err := client.Core().Services(namespace).List(listOptions)
@@ -114,7 +115,7 @@ func listServices(namespace, labelKey, labelValue string) (*v1.ServiceList, erro
 	return list, nil
 }
 
-func getService(serviceName, namespace string) (*v1.Service, error) {
+func getService(client *kubernetes.Clientset, serviceName, namespace string) (*v1.Service, error) {
 	svc, err := client.Core().Services(namespace).Get(serviceName)
 
 	if err != nil {
@@ -125,7 +126,7 @@ func getService(serviceName, namespace string) (*v1.Service, error) {
 	return svc, nil
 }
 
-func createService(namespace string, svc *v1.Service) error {
+func createService(client *kubernetes.Clientset, namespace string, svc *v1.Service) error {
 	_, err := client.Core().Services(namespace).Create(svc)
 
 	if err != nil {
@@ -134,7 +135,7 @@ func createService(namespace string, svc *v1.Service) error {
 	return err
 }
 
-func deleteService(namespace, name string) error {
+func deleteService(client *kubernetes.Clientset, namespace, name string) error {
 	// TODO: nil?
 	err := client.Core().Services(namespace).Delete(name, nil)
 
@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// deployStatus is the outcome of the most recent deploy of a branch
+type deployStatus struct {
+	Cluster  string            `json:"cluster"`
+	Branch   string            `json:"branch"`
+	User     string            `json:"user,omitempty"`
+	State    string            `json:"state"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Evicted  []string          `json:"evicted,omitempty"`
+	Images   []imageResolution `json:"images,omitempty"`
+	Hooks    []hookResult      `json:"hooks,omitempty"`
+}
+
+// states a deploy moves through
+const (
+	deployRunning   = "running"
+	deploySucceeded = "succeeded"
+	deployFailed    = "failed"
+)
+
+var deployStatuses = struct {
+	sync.Mutex
+	byBranch map[string]*deployStatus
+}{byBranch: make(map[string]*deployStatus)}
+
+// startDeployStatus records that a deploy of the plan has started
+func startDeployStatus(plan *deployPlan) *deployStatus {
+	status := &deployStatus{
+		Cluster: plan.Cluster,
+		Branch:  plan.Namespace,
+		User:    plan.User,
+		State:   deployRunning,
+		Started: time.Now(),
+		Images:  plan.Images,
+	}
+
+	deployStatuses.Lock()
+	deployStatuses.byBranch[jobKey(plan.cluster, plan.Namespace)] = status
+	deployStatuses.Unlock()
+
+	return status
+}
+
+// addHook records the result of a hook
+func (s *deployStatus) addHook(result hookResult) {
+	deployStatuses.Lock()
+	s.Hooks = append(s.Hooks, result)
+	deployStatuses.Unlock()
+}
+
+// finish marks the deploy as done, err is nil when it succeeded
+func (s *deployStatus) finish(err error) {
+	deployStatuses.Lock()
+	defer deployStatuses.Unlock()
+
+	now := time.Now()
+	s.Finished = &now
+	s.State = deploySucceeded
+
+	if err != nil {
+		s.State = deployFailed
+		s.Error = err.Error()
+	}
+}
+
+// snapshot copies the status so it can be encoded without holding the lock
+func (s *deployStatus) snapshot() deployStatus {
+	deployStatuses.Lock()
+	defer deployStatuses.Unlock()
+
+	copied := *s
+	copied.Hooks = append([]hookResult(nil), s.Hooks...)
+	return copied
+}
+
+// getDeployStatus returns the status of the last deploy of a branch to a cluster
+func getDeployStatus(c *cluster, branchName string) (deployStatus, bool) {
+	deployStatuses.Lock()
+	status, ok := deployStatuses.byBranch[jobKey(c, branchName)]
+	deployStatuses.Unlock()
+
+	if !ok {
+		return deployStatus{}, false
+	}
+	return status.snapshot(), true
+}
+
+// Status (GET "/deploy/branchName/status")
+func getDeployStatusRoute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	branchName := vars["branchName"]
+
+	// sanitize BranchName
+	branchName = sanitizeBranchName(branchName)
+
+	c, ok := requestCluster(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := authorize(w, r, actionRead, c.Name, branchImageNamespace(c, branchName), branchName); !ok {
+		return
+	}
+
+	status, ok := getDeployStatus(c, branchName)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			panic(err)
+		}
+	}
+}
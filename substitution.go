@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annotation on a template object which turns placeholder expansion on ("true")
+// or off ("false") regardless of the substitute argument
+const substituteAnnotation = "emmie-substitute"
+
+// substituter expands placeholders such as {{.Branch}} in values copied from
+// the template and collects any errors so they can be reported together
+type substituter struct {
+	params map[string]interface{}
+	errors []string
+}
+
+// newSubstituter creates a substituter with the values known for a branch
+func newSubstituter(c *cluster, branchName, imageNamespace, templateNamespace string) *substituter {
+	return &substituter{
+		params: map[string]interface{}{
+			"Branch":            branchName,
+			"Namespace":         branchName,
+			"ImageNamespace":    imageNamespace,
+			"TemplateNamespace": templateNamespace,
+			"Cluster":           c.Name,
+			"SubDomain":         c.SubDomain,
+			"Host":              fmt.Sprintf("%s.%s", branchName, c.SubDomain),
+			"Hosts":             map[string]string{},
+		},
+	}
+}
+
+// setHosts makes the ingress hosts available, {{.Host}} becomes the first one
+func (s *substituter) setHosts(hosts map[string]string, first string) {
+	s.params["Hosts"] = hosts
+	if host, ok := hosts[first]; ok {
+		s.params["Host"] = host
+	}
+}
+
+// enabled checks whether placeholders of a template object are expanded
+func (s *substituter) enabled(annotations map[string]string) bool {
+	switch annotations[substituteAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		return *argSubstitute
+	}
+}
+
+// hostIndex looks up the host of an ingress for {{index .Hosts "web"}}, unlike
+// the builtin it fails on a missing key like any other unknown placeholder
+func hostIndex(hosts map[string]string, name string) (string, error) {
+	host, ok := hosts[name]
+	if !ok {
+		return "", fmt.Errorf("no ingress named %q", name)
+	}
+	return host, nil
+}
+
+// expand renders a single value, where describes the value for error messages
+func (s *substituter) expand(where, text string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+
+	t, err := template.New(where).Option("missingkey=error").Funcs(template.FuncMap{"index": hostIndex}).Parse(text)
+	if err != nil {
+		s.errors = append(s.errors, fmt.Sprintf("%s: %v", where, err))
+		return text
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, s.params); err != nil {
+		s.errors = append(s.errors, fmt.Sprintf("%s: %v", where, err))
+		return text
+	}
+
+	return out.String()
+}
+
+// expandMap returns a copy of m with every value expanded
+func (s *substituter) expandMap(where string, m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	expanded := make(map[string]string, len(m))
+	for key, value := range m {
+		expanded[key] = s.expand(fmt.Sprintf("%s[%s]", where, key), value)
+	}
+
+	return expanded
+}
+
+// expandContainers expands the env values of each container in place
+func (s *substituter) expandContainers(where string, containers []v1.Container) {
+	for i, container := range containers {
+		for j, env := range container.Env {
+			containers[i].Env[j].Value = s.expand(fmt.Sprintf("%s/%s env %s", where, container.Name, env.Name), env.Value)
+		}
+	}
+}
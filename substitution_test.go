@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import "testing"
+
+func TestSubstituterExpand(t *testing.T) {
+	tests := []struct {
+		text   string
+		want   string
+		failed bool
+	}{
+		{text: "plain value", want: "plain value"},
+		{text: "{{.Branch}}", want: "feature-x"},
+		{text: "http://{{.Host}}/api", want: "http://web-feature-x.ci.example.com/api"},
+		{text: "{{.Cluster}}/{{.ImageNamespace}}/{{.TemplateNamespace}}", want: "dev/payments/template"},
+		{text: `{{index .Hosts "web"}}`, want: "web-feature-x.ci.example.com"},
+		{text: `{{index .Hosts "missing"}}`, want: `{{index .Hosts "missing"}}`, failed: true},
+		{text: "{{.Unknown}}", want: "{{.Unknown}}", failed: true},
+		{text: "{{.Branch", want: "{{.Branch", failed: true},
+	}
+
+	for _, test := range tests {
+		sub := newSubstituter(&cluster{Name: "dev", SubDomain: "ci.example.com"}, "feature-x", "payments", "template")
+		sub.setHosts(map[string]string{"web": "web-feature-x.ci.example.com"}, "web")
+
+		got := sub.expand("test", test.text)
+		if got != test.want {
+			t.Errorf("expand(%q) = %q, want %q", test.text, got, test.want)
+		}
+		if failed := len(sub.errors) > 0; failed != test.failed {
+			t.Errorf("expand(%q) errors = %v, want failure %v", test.text, sub.errors, test.failed)
+		}
+	}
+}
+
+func TestSubstituterEnabled(t *testing.T) {
+	defer func(substitute bool) { *argSubstitute = substitute }(*argSubstitute)
+
+	tests := []struct {
+		substitute  bool
+		annotations map[string]string
+		want        bool
+	}{
+		{substitute: false, annotations: nil, want: false},
+		{substitute: false, annotations: map[string]string{substituteAnnotation: "true"}, want: true},
+		{substitute: false, annotations: map[string]string{substituteAnnotation: "false"}, want: false},
+		{substitute: true, annotations: nil, want: true},
+		{substitute: true, annotations: map[string]string{substituteAnnotation: "false"}, want: false},
+		{substitute: true, annotations: map[string]string{substituteAnnotation: "true"}, want: true},
+	}
+
+	sub := newSubstituter(&cluster{Name: "dev"}, "feature-x", "payments", "template")
+	for _, test := range tests {
+		*argSubstitute = test.substitute
+		if got := sub.enabled(test.annotations); got != test.want {
+			t.Errorf("enabled(%v) with substitute=%v = %v, want %v", test.annotations, test.substitute, got, test.want)
+		}
+	}
+}
+
+func TestSubstituterExpandMap(t *testing.T) {
+	sub := newSubstituter(&cluster{Name: "dev", SubDomain: "ci.example.com"}, "feature-x", "payments", "template")
+
+	if got := sub.expandMap("test", nil); got != nil {
+		t.Errorf("expandMap(nil) = %v, want nil", got)
+	}
+
+	in := map[string]string{"url": "https://{{.Host}}", "helm": "{{ .Values.x }}"}
+	got := sub.expandMap("ConfigMap/app", in)
+	if got["url"] != "https://feature-x.ci.example.com" {
+		t.Errorf("expandMap url = %q", got["url"])
+	}
+	if in["url"] != "https://{{.Host}}" {
+		t.Errorf("expandMap changed its input: %v", in)
+	}
+	if len(sub.errors) != 1 {
+		t.Errorf("expandMap errors = %v, want one for the unknown Values key", sub.errors)
+	}
+}
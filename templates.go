@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annotations on a branch namespace recording which template it was cloned
+// from and which image namespace it was deployed with
+const (
+	templateAnnotation       = "emmie-template"
+	imageNamespaceAnnotation = "emmie-image-namespace"
+)
+
+// allowedTemplateNamespaces lists the template namespaces a deploy to a cluster may use
+func allowedTemplateNamespaces(c *cluster) []string {
+	templates := []string{c.TemplateNamespace}
+
+	for _, name := range strings.Split(*argTemplates, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != c.TemplateNamespace {
+			templates = append(templates, name)
+		}
+	}
+
+	return templates
+}
+
+// templateNamespaceAllowed checks a template namespace is on the allow-list
+func templateNamespaceAllowed(c *cluster, name string) bool {
+	for _, template := range allowedTemplateNamespaces(c) {
+		if template == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// templateNamespaceFor returns the template a branch namespace was cloned from
+func templateNamespaceFor(c *cluster, ns *v1.Namespace) string {
+	if template, ok := ns.Annotations[templateAnnotation]; ok && template != "" {
+		return template
+	}
+
+	return c.TemplateNamespace
+}
+
+// setTemplateAnnotation records the template namespace in a set of annotations
+func setTemplateAnnotation(annotations map[string]string, templateNamespace string) map[string]string {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	annotations[templateAnnotation] = templateNamespace
+	return annotations
+}
+
+// resolveTemplateNamespace picks the template for a deploy, falling back to
+// the one the branch was last deployed from and then to the default
+func resolveTemplateNamespace(c *cluster, requested, branchName string) (string, error) {
+	if requested != "" {
+		if !templateNamespaceAllowed(c, requested) {
+			return "", fmt.Errorf("template namespace %q is not allowed", requested)
+		}
+		return requested, nil
+	}
+
+	if ns, err := getNamespace(c.client, branchName); err == nil {
+		return templateNamespaceFor(c, ns), nil
+	}
+
+	return c.TemplateNamespace, nil
+}
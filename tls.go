@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in the cert and key files, loading
+// it again when either file changes
+type certReloader struct {
+	sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+// newCertReloader loads the certificate, which has to work the first time
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the cert and key files
+func (c *certReloader) reload() error {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	c.Unlock()
+
+	log.Println("[certReloader] Loaded certificate from", c.certPath)
+	return nil
+}
+
+// changed checks whether either file differs from the ones last loaded,
+// stat follows symlinks so the swap of a kubernetes secret volume is seen
+func (c *certReloader) changed() bool {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	return !certInfo.ModTime().Equal(c.certMod) || !keyInfo.ModTime().Equal(c.keyMod)
+}
+
+// watch reloads the certificate when the files change, a pair which doesn't
+// load (e.g. the cert was replaced before the key) leaves the old one in use
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.changed() {
+			continue
+		}
+
+		if err := c.reload(); err != nil {
+			log.Println("[certReloader] Error reloading certificate, keeping the previous one:", err)
+		}
+	}
+}
+
+// getCertificate hands the current certificate to each TLS handshake
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.cert, nil
+}
+
+// selfSignedCertificate generates a certificate for this host, valid for a year
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Emmie"}, CommonName: "emmie"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost", "emmie"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// checkTLSFlags makes sure the API has a certificate, or is deliberately served
+// without one, before emmie starts
+func checkTLSFlags() error {
+	if *argInsecureHTTP || *argTLSSelfSigned {
+		return nil
+	}
+	if *argTLSCert == "" || *argTLSKey == "" {
+		return fmt.Errorf("set tls-cert and tls-key, tls-self-signed or insecure-http")
+	}
+	if *argTLSReload <= 0 {
+		return fmt.Errorf("tls-reload must be positive, got %v", *argTLSReload)
+	}
+	return nil
+}
+
+// serve listens for API requests over TLS, or plain HTTP when insecure-http is set
+func serve(handler http.Handler) error {
+	addr := fmt.Sprintf(":%d", *argListenPort)
+
+	if *argInsecureHTTP {
+		log.Println("[Emmie] Serving plain HTTP on", addr)
+		return http.ListenAndServe(addr, handler)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *argTLSSelfSigned {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return fmt.Errorf("generating self-signed certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{*cert}
+		log.Println("[Emmie] Serving HTTPS with a self-signed certificate on", addr)
+	} else {
+		reloader, err := newCertReloader(*argTLSCert, *argTLSKey)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %v", err)
+		}
+		go reloader.watch(*argTLSReload)
+		config.GetCertificate = reloader.getCertificate
+		log.Println("[Emmie] Serving HTTPS on", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	return server.Serve(tls.NewListener(listener, config))
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckTLSFlags(t *testing.T) {
+	defer func(cert, key string, reload time.Duration, selfSigned, insecure bool) {
+		*argTLSCert, *argTLSKey, *argTLSReload, *argTLSSelfSigned, *argInsecureHTTP = cert, key, reload, selfSigned, insecure
+	}(*argTLSCert, *argTLSKey, *argTLSReload, *argTLSSelfSigned, *argInsecureHTTP)
+
+	tests := []struct {
+		cert, key            string
+		reload               time.Duration
+		selfSigned, insecure bool
+		ok                   bool
+	}{
+		{reload: time.Second},
+		{cert: "cert.pem", reload: time.Second},
+		{cert: "cert.pem", key: "key.pem", reload: time.Second, ok: true},
+		{cert: "cert.pem", key: "key.pem"},
+		{cert: "cert.pem", key: "key.pem", reload: -time.Second},
+		{selfSigned: true, ok: true},
+		{insecure: true, ok: true},
+	}
+
+	for _, test := range tests {
+		*argTLSCert, *argTLSKey, *argTLSReload, *argTLSSelfSigned, *argInsecureHTTP = test.cert, test.key, test.reload, test.selfSigned, test.insecure
+		if err := checkTLSFlags(); (err == nil) != test.ok {
+			t.Errorf("checkTLSFlags() with %+v = %v, want ok %v", test, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// actions a token can be allowed to take
+const (
+	actionDeploy = "deploy"
+	actionDelete = "delete"
+	actionRead   = "read"
+	actionSleep  = "sleep"
+)
+
+var knownActions = []string{actionDeploy, actionDelete, actionRead, actionSleep}
+
+// apiToken is a token from the tokens file and what it may do, empty clusters,
+// image namespaces or branches allow every cluster, image namespace or branch
+type apiToken struct {
+	Name            string     `json:"name"`
+	Token           string     `json:"token"`
+	Actions         []string   `json:"actions"`
+	Clusters        []string   `json:"clusters,omitempty"`
+	ImageNamespaces []string   `json:"imageNamespaces,omitempty"`
+	Branches        []string   `json:"branches,omitempty"`
+	Expires         *time.Time `json:"expires,omitempty"`
+}
+
+// tokensFile is the structured form of the tokens file
+type tokensFile struct {
+	Tokens []apiToken `json:"tokens"`
+}
+
+// storedToken is a loaded token, kept as a hash so lookups compare in constant time
+type storedToken struct {
+	hash  [sha256.Size]byte
+	token apiToken
+}
+
+// tokenStore holds the tokens read from the tokens file, when the file can't
+// be read the last tokens loaded are kept and the error is remembered
+type tokenStore struct {
+	sync.RWMutex
+	path    string
+	tokens  []storedToken
+	modTime time.Time
+	size    int64
+	loaded  bool
+	err     error
+}
+
+// tokens accepted by the API, nil when auth is disabled
+var tokens *tokenStore
+
+// anonymous is the caller of every request when auth is disabled
+var anonymous = &identity{
+	Name:   "anonymous",
+	grants: []*apiToken{{Name: "anonymous", Actions: knownActions}},
+}
+
+// parseTokens reads a structured tokens file, or one token per line with
+// every permission for the plain format. Only a file without any colon is
+// read as plain tokens, so a structured file with a mistake in it is refused
+// rather than turning each of its lines into a token
+func parseTokens(data []byte) ([]apiToken, error) {
+	if bytes.Contains(data, []byte(":")) {
+		file := tokensFile{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid tokens file: %v", err)
+		}
+		if len(file.Tokens) == 0 {
+			return nil, fmt.Errorf("invalid tokens file: no tokens listed")
+		}
+		for i, token := range file.Tokens {
+			if err := validateToken(token); err != nil {
+				return nil, fmt.Errorf("token %d: %v", i+1, err)
+			}
+		}
+		return file.Tokens, nil
+	}
+
+	parsed := []apiToken{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		token := strings.TrimSpace(scanner.Text())
+		if token != "" {
+			parsed = append(parsed, apiToken{
+				Name:    fmt.Sprintf("line-%d", line),
+				Token:   token,
+				Actions: knownActions,
+			})
+		}
+	}
+	return parsed, scanner.Err()
+}
+
+// validateToken checks a structured token is complete and its patterns compile
+func validateToken(token apiToken) error {
+	if err := validatePermissions(token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		return fmt.Errorf("%s has no token", token.Name)
+	}
+	return nil
+}
+
+// validatePermissions checks the name, actions, clusters and branch patterns of a token or group
+func validatePermissions(token apiToken) error {
+	if token.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if len(token.Actions) == 0 {
+		return fmt.Errorf("%s has no actions", token.Name)
+	}
+	for _, action := range token.Actions {
+		if !contains(knownActions, action) {
+			return fmt.Errorf("%s has unknown action %q", token.Name, action)
+		}
+	}
+	for _, name := range token.Clusters {
+		if name == "" {
+			return fmt.Errorf("%s has an empty cluster name", token.Name)
+		}
+	}
+	for _, pattern := range token.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s has invalid branch pattern %q", token.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// newTokenStore loads the tokens file at path, a failed first load leaves the
+// store without tokens so every request is refused until a reload succeeds
+func newTokenStore(path string) *tokenStore {
+	store := &tokenStore{path: path}
+	if err := store.reload(); err != nil {
+		log.Println("[newTokenStore] Error loading tokens, refusing all requests until they load:", err)
+	}
+	return store
+}
+
+// reload reads and parses the tokens file
+func (s *tokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadFile(s.path)
+		if err == nil {
+			var parsed []apiToken
+			parsed, err = parseTokens(data)
+			if err == nil {
+				stored := make([]storedToken, len(parsed))
+				for i, token := range parsed {
+					stored[i] = storedToken{hash: sha256.Sum256([]byte(token.Token)), token: token}
+				}
+
+				s.Lock()
+				s.tokens = stored
+				s.modTime = info.ModTime()
+				s.size = info.Size()
+				s.loaded = true
+				s.err = nil
+				s.Unlock()
+
+				log.Printf("[tokenStore] Loaded %d tokens from %s", len(stored), s.path)
+				return nil
+			}
+		}
+	}
+
+	s.Lock()
+	s.err = err
+	s.Unlock()
+	return err
+}
+
+// changed checks whether the tokens file differs from the one last loaded,
+// stat follows symlinks so the swap of a kubernetes secret volume is seen
+func (s *tokenStore) changed() bool {
+	info, err := os.Stat(s.path)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if err != nil {
+		// a missing file is only worth retrying if the last attempt worked
+		return s.err == nil
+	}
+	return !s.loaded || s.err != nil || !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// watch reloads the tokens file when it changes or emmie receives SIGHUP
+func (s *tokenStore) watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+			log.Println("[tokenStore] SIGHUP received, reloading tokens")
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+		}
+
+		if err := s.reload(); err != nil {
+			log.Println("[tokenStore] Error reloading tokens, keeping the previous tokens:", err)
+		}
+	}
+}
+
+// lookup finds a token, comparing against every loaded token in constant time
+func (s *tokenStore) lookup(token string) *apiToken {
+	hash := sha256.Sum256([]byte(token))
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var found *apiToken
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare(hash[:], s.tokens[i].hash[:]) == 1 {
+			match := s.tokens[i].token
+			found = &match
+		}
+	}
+	return found
+}
+
+// allows checks whether the token may take an action, the cluster is only
+// checked when clusterName is set and the image namespace and branch when
+// branchName is set
+func (t *apiToken) allows(action, clusterName, imageNamespace, branchName string) error {
+	if t.Expires != nil && time.Now().After(*t.Expires) {
+		return fmt.Errorf("token expired at %s", t.Expires.Format(time.RFC3339))
+	}
+
+	if !contains(t.Actions, action) {
+		return fmt.Errorf("action %s not allowed", action)
+	}
+
+	if clusterName != "" && len(t.Clusters) > 0 && !contains(t.Clusters, clusterName) {
+		return fmt.Errorf("cluster %s not allowed", clusterName)
+	}
+
+	if branchName == "" {
+		return nil
+	}
+
+	if len(t.ImageNamespaces) > 0 && !contains(t.ImageNamespaces, imageNamespace) {
+		return fmt.Errorf("image namespace %q not allowed", imageNamespace)
+	}
+
+	if len(t.Branches) == 0 {
+		return nil
+	}
+	for _, pattern := range t.Branches {
+		if matched, _ := path.Match(pattern, branchName); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("branch %s not allowed", branchName)
+}
+
+// identity is the caller of a request and the permissions it was granted,
+// a token grants its own permissions, an OIDC user those of their groups and
+// the cluster decides for a user it authenticated
+type identity struct {
+	Name   string
+	grants []*apiToken
+	kube   *kubeUser
+}
+
+// allows checks whether any of the caller's grants allows the action
+func (id *identity) allows(action, clusterName, imageNamespace, branchName string) error {
+	if id.kube != nil {
+		return id.kube.allows(action, clusterName, imageNamespace, branchName)
+	}
+
+	err := fmt.Errorf("no permissions granted")
+	for _, grant := range id.grants {
+		if err = grant.allows(action, clusterName, imageNamespace, branchName); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// authEnabled checks whether any way of authenticating requests is configured
+func authEnabled() bool {
+	return tokens != nil || oidc != nil || *argKubeAuth
+}
+
+// authenticate finds the caller of a request from its token
+func authenticate(r *http.Request) (*identity, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, fmt.Errorf("no token")
+	}
+
+	if tokens != nil {
+		if found := tokens.lookup(token); found != nil {
+			if found.Expires != nil && time.Now().After(*found.Expires) {
+				return nil, fmt.Errorf("token %s expired at %s", found.Name, found.Expires.Format(time.RFC3339))
+			}
+			return &identity{Name: found.Name, grants: []*apiToken{found}}, nil
+		}
+	}
+
+	// service account tokens are JWTs too, so the cluster gets a turn when the issuer refuses one
+	if oidc != nil && looksLikeJWT(token) {
+		caller, err := oidc.authenticate(token)
+		if err == nil || !*argKubeAuth {
+			return caller, err
+		}
+	}
+
+	if *argKubeAuth {
+		return reviewToken(token)
+	}
+
+	return nil, fmt.Errorf("unknown token")
+}
+
+// authorize finds the caller of a request and checks it may take the action
+// on a cluster, responding with 401 or 403 when it can't. An empty clusterName
+// is for requests which aren't about any one cluster
+func authorize(w http.ResponseWriter, r *http.Request, action, clusterName, imageNamespace, branchName string) (*identity, bool) {
+	caller, ok := requestCaller(w, r, action, clusterName, imageNamespace, branchName)
+	if !ok || caller == anonymous {
+		return caller, ok
+	}
+
+	if err := caller.allows(action, clusterName, imageNamespace, branchName); err != nil {
+		log.Printf("[authorize] Refusing %s %s for %s: %v", action, redactURL(r.URL), caller.Name, err)
+		auditDenial(action, caller.Name, clusterName, imageNamespace, branchName, err)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+
+	log.Printf("[authorize] Allowing %s %s for %s", action, redactURL(r.URL), caller.Name)
+	return caller, true
+}
+
+// requestCaller finds the caller of a request, responding with 401 when its
+// token isn't accepted
+func requestCaller(w http.ResponseWriter, r *http.Request, action, clusterName, imageNamespace, branchName string) (*identity, bool) {
+	// If no tokens, issuer or kube auth are configured, then auth is disabled
+	if !authEnabled() {
+		return anonymous, true
+	}
+
+	caller, err := authenticate(r)
+	if err != nil {
+		log.Printf("[authorize] Refusing %s %s: %v", action, redactURL(r.URL), err)
+		auditDenial(action, "", clusterName, imageNamespace, branchName, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return caller, true
+}
+
+// authorizeListing finds the caller of a listing and the clusters it covers,
+// every cluster the caller may read unless the request names one, which the
+// caller then has to be allowed to read. Without a cluster each one is checked
+// on its own, so a user who may only read some clusters (e.g. through a
+// RoleBinding in the namespace named after one) gets those rather than 403
+func authorizeListing(w http.ResponseWriter, r *http.Request) ([]*cluster, bool) {
+	listed, ok := requestClusters(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if r.FormValue("cluster") != "" {
+		_, ok := authorize(w, r, actionRead, listed[0].Name, "", "")
+		return listed, ok
+	}
+
+	caller, ok := requestCaller(w, r, actionRead, "", "", "")
+	if !ok || caller == anonymous {
+		return listed, ok
+	}
+
+	readable := []*cluster{}
+	err := fmt.Errorf("no clusters")
+	for _, c := range listed {
+		if err = caller.allows(actionRead, c.Name, "", ""); err == nil {
+			readable = append(readable, c)
+		}
+	}
+	if len(readable) == 0 {
+		log.Printf("[authorize] Refusing %s %s for %s: %v", actionRead, redactURL(r.URL), caller.Name, err)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+
+	log.Printf("[authorize] Allowing %s %s for %s on %s", actionRead, redactURL(r.URL), caller.Name, strings.Join(clusterNames(readable), ", "))
+	return readable, true
+}
+
+// auditDenial records a refused deploy or delete, reads aren't audited
+func auditDenial(action, caller, clusterName, imageNamespace, branchName string, err error) {
+	if action == actionRead || branchName == "" {
+		return
+	}
+
+	audit.record(auditEntry{
+		Caller:         caller,
+		Cluster:        clusterName,
+		Action:         action,
+		Branch:         branchName,
+		ImageNamespace: imageNamespace,
+		Outcome:        auditDenied,
+		Error:          err.Error(),
+	})
+}
+
+// requestToken reads the bearer token from the Authorization header, falling
+// back to the token query parameter when allow-query-token is set
+func requestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	if *argQueryToken {
+		return r.FormValue("token")
+	}
+	if r.URL.Query().Get("token") != "" {
+		log.Println("[requestToken] Ignoring token query parameter, send it in the Authorization header")
+	}
+	return ""
+}
+
+// redactURL formats a request url for the log with any token hidden
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query["token"]; !ok {
+		return u.String()
+	}
+
+	query.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// branchImageNamespace is the image namespace an environment of a cluster was deployed from
+func branchImageNamespace(c *cluster, branchName string) string {
+	ns, err := getNamespace(c.client, branchName)
+	if err != nil {
+		return ""
+	}
+	return ns.Annotations[imageNamespaceAnnotation]
+}
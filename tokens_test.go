@@ -0,0 +1,323 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	authorizationapi "k8s.io/client-go/1.4/pkg/apis/authorization/v1beta1"
+	"k8s.io/client-go/1.4/rest"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	later := time.Now().Add(time.Hour)
+
+	ci := &apiToken{
+		Name:            "ci",
+		Actions:         []string{actionDeploy, actionRead},
+		Clusters:        []string{"dev"},
+		ImageNamespaces: []string{"payments"},
+		Branches:        []string{"feature-*", "develop"},
+		Expires:         &later,
+	}
+
+	tests := []struct {
+		name           string
+		token          *apiToken
+		action         string
+		cluster        string
+		imageNamespace string
+		branchName     string
+		allowed        bool
+	}{
+		{name: "listing", token: ci, action: actionRead, allowed: true},
+		{name: "listing of its cluster", token: ci, action: actionRead, cluster: "dev", allowed: true},
+		{name: "listing of another cluster", token: ci, action: actionRead, cluster: "qa"},
+		{name: "matching branch", token: ci, action: actionDeploy, cluster: "dev", imageNamespace: "payments", branchName: "feature-login", allowed: true},
+		{name: "exact branch", token: ci, action: actionDeploy, cluster: "dev", imageNamespace: "payments", branchName: "develop", allowed: true},
+		{name: "other cluster", token: ci, action: actionDeploy, cluster: "qa", imageNamespace: "payments", branchName: "feature-login"},
+		{name: "other branch", token: ci, action: actionDeploy, cluster: "dev", imageNamespace: "payments", branchName: "master"},
+		{name: "other image namespace", token: ci, action: actionDeploy, cluster: "dev", imageNamespace: "billing", branchName: "feature-login"},
+		{name: "action not granted", token: ci, action: actionDelete, cluster: "dev", imageNamespace: "payments", branchName: "feature-login"},
+		{name: "expired", token: &apiToken{Name: "old", Actions: knownActions, Expires: &expired}, action: actionRead},
+		{name: "unscoped", token: &apiToken{Name: "admin", Actions: knownActions}, action: actionDelete, cluster: "qa", imageNamespace: "billing", branchName: "master", allowed: true},
+	}
+
+	for _, test := range tests {
+		err := test.token.allows(test.action, test.cluster, test.imageNamespace, test.branchName)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: allows(%s, %q, %q, %q) = %v, want allowed %v", test.name, test.action, test.cluster, test.imageNamespace, test.branchName, err, test.allowed)
+		}
+	}
+}
+
+func TestIdentityAllowsAnyGrant(t *testing.T) {
+	caller := &identity{
+		Name: "alice@example.com",
+		grants: []*apiToken{
+			{Name: "payments", Actions: []string{actionDeploy}, Clusters: []string{"dev"}, ImageNamespaces: []string{"payments"}},
+			{Name: "readers", Actions: []string{actionRead}},
+		},
+	}
+
+	if err := caller.allows(actionDeploy, "dev", "payments", "feature-x"); err != nil {
+		t.Errorf("deploy of payments refused: %v", err)
+	}
+	if err := caller.allows(actionRead, "qa", "billing", "feature-x"); err != nil {
+		t.Errorf("read of billing refused: %v", err)
+	}
+	if err := caller.allows(actionDeploy, "dev", "billing", "feature-x"); err == nil {
+		t.Error("deploy of billing allowed")
+	}
+	if err := caller.allows(actionDeploy, "qa", "payments", "feature-x"); err == nil {
+		t.Error("deploy of payments to qa allowed")
+	}
+	if err := (&identity{Name: "nobody"}).allows(actionRead, "", "", ""); err == nil {
+		t.Error("an identity without grants was allowed to read")
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	plain, err := parseTokens([]byte("abc\n\n  def  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) != 2 || plain[0].Token != "abc" || plain[1].Token != "def" || plain[1].Name != "line-3" {
+		t.Errorf("plain tokens = %+v", plain)
+	}
+
+	structured, err := parseTokens([]byte("tokens:\n- name: ci\n  token: abc\n  actions: [deploy]\n  branches: [feature-*]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(structured) != 1 || structured[0].Name != "ci" || structured[0].Branches[0] != "feature-*" {
+		t.Errorf("structured tokens = %+v", structured)
+	}
+
+	for _, data := range []string{
+		"tokens:\n- name: ci\n  token: abc\n  actions: [launch]\n",
+		"tokens:\n- name: ci\n  actions: [deploy]\n",
+		"tokens:\n- name: ci\n  token: abc\n  actions: [deploy]\n  branches: ['[']\n",
+		"tokens:\n- name: ci\n  token: abc\n  actions: [deploy]\n  clusters: ['']\n",
+		"tokens:\n- name: ci\n  token: abc\n  actions: [deploy]\n  expires: 2027-01-01\n",
+		"tokens:\n- name: ci\n  token: abc\n  actions: [deploy]\n  branches: feature-*\n",
+		"tokens: []\n",
+		"tokens:\n- name: ci\n  token: abc\n  actions: [deploy\n",
+	} {
+		if _, err := parseTokens([]byte(data)); err == nil {
+			t.Errorf("parseTokens(%q) succeeded", data)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "/deploy", want: "/deploy"},
+		{url: "/deploy/payments/feature-x?dryRun=true", want: "/deploy/payments/feature-x?dryRun=true"},
+		{url: "/deploy/payments/feature-x?token=secret", want: "/deploy/payments/feature-x?token=REDACTED"},
+		{url: "/deploy?cluster=qa&token=secret&token=other", want: "/deploy?cluster=qa&token=REDACTED"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactURL(u); got != test.want {
+			t.Errorf("redactURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	defer func(allow bool) { *argQueryToken = allow }(*argQueryToken)
+
+	tests := []struct {
+		allowQuery bool
+		header     string
+		url        string
+		want       string
+	}{
+		{allowQuery: true, header: "Bearer abc", url: "/deploy?token=def", want: "abc"},
+		{allowQuery: true, header: "bearer  abc ", url: "/deploy", want: "abc"},
+		{allowQuery: true, header: "Basic abc", url: "/deploy?token=def", want: "def"},
+		{allowQuery: false, header: "", url: "/deploy?token=def", want: ""},
+		{allowQuery: false, header: "Bearer abc", url: "/deploy?token=def", want: "abc"},
+	}
+
+	for _, test := range tests {
+		*argQueryToken = test.allowQuery
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := requestToken(r); got != test.want {
+			t.Errorf("requestToken(%q, %q) with allow-query-token=%v = %q, want %q", test.header, test.url, test.allowQuery, got, test.want)
+		}
+	}
+}
+
+func TestAuthorizeListing(t *testing.T) {
+	defer func(listed []*cluster, first *cluster, store *tokenStore) {
+		clusters, defaultCluster, tokens = listed, first, store
+	}(clusters, defaultCluster, tokens)
+
+	clusters = []*cluster{{Name: "dev"}, {Name: "qa"}}
+	defaultCluster = clusters[0]
+	devReader := apiToken{Name: "dev-reader", Token: "abc", Actions: []string{actionRead}, Clusters: []string{"dev"}}
+	tokens = &tokenStore{tokens: []storedToken{{hash: sha256.Sum256([]byte(devReader.Token)), token: devReader}}}
+
+	tests := []struct {
+		url  string
+		code int
+		want []string
+	}{
+		{url: "/capacity", code: 200, want: []string{"dev"}},
+		{url: "/capacity?cluster=dev", code: 200, want: []string{"dev"}},
+		{url: "/capacity?cluster=qa", code: 403},
+		{url: "/capacity?cluster=prod", code: 400},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		r.Header.Set("Authorization", "Bearer abc")
+		w := httptest.NewRecorder()
+
+		listed, ok := authorizeListing(w, r)
+		if ok != (test.code == 200) || w.Code != test.code {
+			t.Errorf("%s: ok %v with code %d, want code %d", test.url, ok, w.Code, test.code)
+			continue
+		}
+		if names := clusterNames(listed); ok && (len(names) != len(test.want) || names[0] != test.want[0]) {
+			t.Errorf("%s: listed %v, want %v", test.url, names, test.want)
+		}
+	}
+}
+
+func TestTokenStoreKeepsTokensOnMalformedFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := ioutil.WriteFile(file.Name(), []byte("tokens:\n- name: ci\n  token: abc\n  actions: [read]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := newTokenStore(file.Name())
+	if store.lookup("abc") == nil {
+		t.Fatal("token abc not loaded")
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("tokens:\n- name: ci\n  token: def\n  actions: [read]\n  expires: 2027-01-01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err == nil {
+		t.Error("a malformed tokens file reloaded")
+	}
+	for _, line := range []string{"tokens:", "- name: ci", "token: def"} {
+		if store.lookup(line) != nil {
+			t.Errorf("line %q of a malformed file became a token", line)
+		}
+	}
+	if store.lookup("abc") == nil {
+		t.Error("the previous tokens were dropped")
+	}
+}
+
+func TestAuthorizeListingKubeUserScopedToCluster(t *testing.T) {
+	defer func(listed []*cluster, first *cluster, store *tokenStore, kubeAuth bool) {
+		clusters, defaultCluster, tokens, *argKubeAuth = listed, first, store, kubeAuth
+	}(clusters, defaultCluster, tokens, *argKubeAuth)
+
+	// each stub cluster only allows reads in the namespace named after it,
+	// as a RoleBinding there would, and nothing cluster wide
+	stubCluster := func(name string) *cluster {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			review := authorizationapi.SubjectAccessReview{}
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				t.Error(err)
+			}
+			review.Status.Allowed = name == "dev" && review.Spec.ResourceAttributes.Namespace == name
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(review)
+		}))
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &cluster{Name: name, client: client}
+	}
+
+	clusters = []*cluster{stubCluster("dev"), stubCluster("qa")}
+	defaultCluster = clusters[0]
+	tokens = nil
+	*argKubeAuth = true
+
+	for _, token := range []string{"dev-user", "nobody"} {
+		tokenReviews.Lock()
+		tokenReviews.byHash[sha256.Sum256([]byte(token))] = cachedReview{user: kubeUser{Username: token}, expires: time.Now().Add(time.Minute)}
+		tokenReviews.Unlock()
+	}
+
+	r := httptest.NewRequest("GET", "/capacity", nil)
+	r.Header.Set("Authorization", "Bearer dev-user")
+	w := httptest.NewRecorder()
+	listed, ok := authorizeListing(w, r)
+	if names := clusterNames(listed); !ok || len(names) != 1 || names[0] != "dev" {
+		t.Errorf("listed %v with code %d, want dev only", names, w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/capacity?cluster=qa", nil)
+	r.Header.Set("Authorization", "Bearer dev-user")
+	w = httptest.NewRecorder()
+	if _, ok := authorizeListing(w, r); ok || w.Code != 403 {
+		t.Errorf("listing qa: ok %v with code %d, want 403", ok, w.Code)
+	}
+
+	// with dev swapped for a cluster that allows nothing, no cluster is readable
+	clusters[0] = stubCluster("staging")
+	r = httptest.NewRequest("GET", "/capacity", nil)
+	r.Header.Set("Authorization", "Bearer nobody")
+	w = httptest.NewRecorder()
+	if _, ok := authorizeListing(w, r); ok || w.Code != 403 {
+		t.Errorf("listing without any readable cluster: ok %v with code %d, want 403", ok, w.Code)
+	}
+}
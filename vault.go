@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotation on a template secret naming the vault path to read values from
+const vaultAnnotation = "emmie-vault"
+
+var (
+	vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+	// service account token used to log in to vault with kubernetes auth
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// token from kubernetes auth, reused until shortly before it expires, a
+	// zero expires never does
+	vaultLogin struct {
+		sync.Mutex
+		token   string
+		expires time.Time
+	}
+)
+
+// vaultResponse covers the parts of vault responses emmie reads
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+	Auth   *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// readVaultSecret reads the key/values stored at a vault path, both version
+// 1 and version 2 of the kv secrets engine are supported
+func readVaultSecret(path string) (map[string][]byte, error) {
+	if *argVaultAddr == "" {
+		return nil, errors.New("vault-addr is not set")
+	}
+
+	token, err := vaultToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", vaultURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := doVaultRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data := resp.Data
+
+	// kv version 2 nests the values alongside metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	values := make(map[string][]byte, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			values[key] = []byte(s)
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = encoded
+	}
+
+	return values, nil
+}
+
+// vaultToken returns the token to read secrets with, logging in with the
+// service account when kubernetes auth is configured
+func vaultToken() (string, error) {
+	switch *argVaultAuth {
+	case "token":
+		if *argVaultToken == "" {
+			return "", errors.New("vault-token is not set")
+		}
+		return *argVaultToken, nil
+	case "kubernetes":
+		return vaultKubernetesLogin()
+	default:
+		return "", fmt.Errorf("unknown vault-auth %q", *argVaultAuth)
+	}
+}
+
+// vaultKubernetesLogin exchanges the service account token for a vault token
+func vaultKubernetesLogin() (string, error) {
+	vaultLogin.Lock()
+	defer vaultLogin.Unlock()
+
+	if vaultLogin.token != "" && (vaultLogin.expires.IsZero() || time.Now().Before(vaultLogin.expires)) {
+		return vaultLogin.token, nil
+	}
+
+	jwt, err := ioutil.ReadFile(serviceAccountTokenPath)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"role": *argVaultRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", vaultURL(fmt.Sprintf("auth/%s/login", *argVaultAuthPath)), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := doVaultRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", errors.New("vault login returned no token")
+	}
+
+	vaultLogin.token = resp.Auth.ClientToken
+	vaultLogin.expires = loginExpiry(time.Now(), time.Duration(resp.Auth.LeaseDuration)*time.Second)
+
+	return vaultLogin.token, nil
+}
+
+// loginExpiry is when a vault token with the given lease should be replaced,
+// a minute early (or half way through a shorter lease) so a token never
+// expires mid deploy, a zero lease never expires
+func loginExpiry(now time.Time, lease time.Duration) time.Time {
+	if lease <= 0 {
+		return time.Time{}
+	}
+
+	margin := time.Minute
+	if lease/2 < margin {
+		margin = lease / 2
+	}
+	return now.Add(lease - margin)
+}
+
+// doVaultRequest sends a request to vault and decodes the response
+func doVaultRequest(req *http.Request) (*vaultResponse, error) {
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	vaultResp := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(vaultResp); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %d for %s: %s", resp.StatusCode, req.URL.Path, strings.Join(vaultResp.Errors, ", "))
+	}
+
+	return vaultResp, nil
+}
+
+// vaultURL builds the api url for a vault path
+func vaultURL(path string) string {
+	return fmt.Sprintf("%s/v1/%s", strings.TrimRight(*argVaultAddr, "/"), strings.TrimLeft(path, "/"))
+}
@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoginExpiry(t *testing.T) {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		lease time.Duration
+		want  time.Time
+	}{
+		{lease: 0, want: time.Time{}},
+		{lease: -time.Second, want: time.Time{}},
+		{lease: time.Hour, want: now.Add(59 * time.Minute)},
+		{lease: 2 * time.Minute, want: now.Add(time.Minute)},
+		{lease: 30 * time.Second, want: now.Add(15 * time.Second)},
+	}
+
+	for _, test := range tests {
+		if got := loginExpiry(now, test.lease); !got.Equal(test.want) {
+			t.Errorf("loginExpiry(%v) = %v, want %v", test.lease, got, test.want)
+		}
+	}
+}
+
+// vaultStub serves kubernetes auth logins and a kv version 1 and 2 secret
+type vaultStub struct {
+	logins int
+	lease  int
+}
+
+func (v *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/auth/kubernetes/login":
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role"] != "emmie" || body["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"invalid role or jwt"}})
+			return
+		}
+
+		v.logins++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "vault-token", "lease_duration": v.lease},
+		})
+	case r.Header.Get("X-Vault-Token") != "vault-token":
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+	case r.URL.Path == "/v1/secret/data/web":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"password": "hunter2", "port": 5432},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		})
+	case r.URL.Path == "/v1/secret/web":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"password": "hunter2"},
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+	}
+}
+
+// useVaultStub points the vault arguments at a stub server with kubernetes auth
+func useVaultStub(t *testing.T, stub *vaultStub) func() {
+	server := httptest.NewServer(stub)
+
+	jwt, err := ioutil.TempFile("", "emmie-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt.WriteString("service-account-jwt\n")
+	jwt.Close()
+
+	addr, auth, role, authPath, tokenPath := *argVaultAddr, *argVaultAuth, *argVaultRole, *argVaultAuthPath, serviceAccountTokenPath
+	*argVaultAddr, *argVaultAuth, *argVaultRole, *argVaultAuthPath = server.URL+"/", "kubernetes", "emmie", "kubernetes"
+	serviceAccountTokenPath = jwt.Name()
+	vaultLogin.token, vaultLogin.expires = "", time.Time{}
+
+	return func() {
+		server.Close()
+		os.Remove(jwt.Name())
+		*argVaultAddr, *argVaultAuth, *argVaultRole, *argVaultAuthPath = addr, auth, role, authPath
+		serviceAccountTokenPath = tokenPath
+		vaultLogin.token, vaultLogin.expires = "", time.Time{}
+	}
+}
+
+func TestReadVaultSecret(t *testing.T) {
+	stub := &vaultStub{lease: 3600}
+	defer useVaultStub(t, stub)()
+
+	values, err := readVaultSecret("secret/data/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["password"]) != "hunter2" || string(values["port"]) != "5432" {
+		t.Errorf("kv v2 values = %q", values)
+	}
+	if _, ok := values["metadata"]; ok {
+		t.Errorf("kv v2 metadata was returned as a value: %q", values)
+	}
+
+	values, err = readVaultSecret("/secret/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values["password"]) != "hunter2" {
+		t.Errorf("kv v1 values = %q", values)
+	}
+
+	if stub.logins != 1 {
+		t.Errorf("logged in %d times, want the token to be cached after 1", stub.logins)
+	}
+
+	if _, err := readVaultSecret("secret/missing"); err == nil {
+		t.Error("reading a missing secret succeeded")
+	}
+}
+
+func TestReadVaultSecretNonExpiringLease(t *testing.T) {
+	stub := &vaultStub{lease: 0}
+	defer useVaultStub(t, stub)()
+
+	for i := 0; i < 3; i++ {
+		if _, err := readVaultSecret("secret/web"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.logins != 1 {
+		t.Errorf("logged in %d times with a non-expiring lease, want 1", stub.logins)
+	}
+}
+
+func TestReadVaultSecretShortLease(t *testing.T) {
+	stub := &vaultStub{lease: 30}
+	defer useVaultStub(t, stub)()
+
+	for i := 0; i < 3; i++ {
+		if _, err := readVaultSecret("secret/web"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.logins != 1 {
+		t.Errorf("logged in %d times with a 30s lease, want 1", stub.logins)
+	}
+}
+
+func TestReadVaultSecretLoginFailure(t *testing.T) {
+	stub := &vaultStub{lease: 3600}
+	defer useVaultStub(t, stub)()
+	*argVaultRole = "other"
+
+	if _, err := readVaultSecret("secret/web"); err == nil {
+		t.Error("reading with a refused login succeeded")
+	}
+}